@@ -2,55 +2,91 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"time"
 
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
-	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
 )
 
 type clientConfig struct {
-	id            int
-	batchSize     int
-	serverAddress string
-	loopPeriod    time.Duration
+	id              int
+	batchSize       int
+	serverAddress   transport.Address
+	loopPeriod      time.Duration
+	codec           protocol.Codec
+	compression     protocol.Compression
+	idleTimeout     time.Duration
+	ioTimeout       time.Duration
+	keepalivePeriod time.Duration
+	// maximum amount of batches waiting for an answer
+	window int
+	// maximum encoded size of a batch, counting its header. Zero means
+	// unlimited
+	batchMaxBytes int
+	// receive server events while submitting
+	subscribe bool
+	// nil if TLS is disabled
+	tls *tls.Config
+	// answers the challenge of the server, if it requires authentication
+	secret []byte
+	// verifies the receipts of the server. If nil, only their hash is checked
+	serverKey ed25519.PublicKey
 }
 
 type client struct {
 	config     clientConfig
-	conn       *net.TCPConn
-	connReader *safeio.Reader
-	connWriter *safeio.Writer
+	conn       net.Conn
+	connReader *protocol.Reader
+	connWriter *protocol.Writer
 	betsReader *safeio.Reader
+	receipts   *receiptWriter
+	// bet that did not fit in the previous batch
+	nextBet *protocol.BetMessage
+	sizer   *protocol.Sizer
+	// space reserved for the header of each batch
+	headerSize int
 }
 
-func newClient(config clientConfig, betsReader *safeio.Reader) *client {
+func newClient(config clientConfig, betsReader *safeio.Reader, receipts *receiptWriter) *client {
+	sizer := protocol.NewSizer(config.codec)
+
 	client := &client{
 		config:     config,
 		betsReader: betsReader,
+		receipts:   receipts,
+		sizer:      sizer,
+		// the sequence number is not known until the batch is sent
+		headerSize: sizer.Size(protocol.BatchMessage{
+			Seq:       math.MaxInt,
+			BatchSize: config.batchSize,
+		}),
 	}
 	return client
 }
 
-func (c *client) createClientSocket() error {
-	raddr, err := net.ResolveTCPAddr("tcp", c.config.serverAddress)
+func (c *client) createClientSocket(ctx context.Context) error {
+	conn, err := transport.Dial(ctx, c.config.serverAddress)
 	if err != nil {
 		return err
 	}
-
-	conn, err := net.DialTCP("tcp", nil, raddr)
-	if err != nil {
-		return err
+	if c.config.tls != nil {
+		conn = tls.Client(conn, c.config.tls)
 	}
 
 	c.conn = conn
-	c.connReader = safeio.NewReader(conn)
-	c.connWriter = safeio.NewWriter(conn)
+	c.connReader = protocol.NewReader(conn)
+	c.connWriter = protocol.NewWriter(conn)
 
-	err = protocol.SendFlush(protocol.HelloMessage{AgencyId: c.config.id}, c.connWriter)
+	err = c.handshake()
 	if err != nil {
 		closeErr := closeSocket(c.conn)
 		return errors.Join(err, closeErr)
@@ -59,51 +95,117 @@ func (c *client) createClientSocket() error {
 	return nil
 }
 
-func (c *client) run(ctx context.Context) (err error) {
-	err = c.createClientSocket()
+// Introduces the agency to the server, and switches to the configured
+// codec and compression once the server accepts them
+func (c *client) handshake() error {
+	err := common.SetDeadline(c.conn.SetDeadline, c.config.ioTimeout)
 	if err != nil {
 		return err
 	}
-	closer := common.SpawnCloser(ctx, c.conn, closeSocket)
-	defer func() {
-		closeErr := closer.Close()
-		err = errors.Join(err, closeErr)
-	}()
 
-	for {
-		batch, err := c.readBatch()
-		if errors.Is(err, io.EOF) {
-			break
-		}
+	err = protocol.SendFlush(protocol.HelloMessage{
+		AgencyId:    c.config.id,
+		Codec:       c.config.codec.Code(),
+		Compression: c.config.compression.Code(),
+	}, c.connWriter)
+	if err != nil {
+		return err
+	}
+
+	answer, err := protocol.ReceiveAny(c.connReader)
+	if err != nil {
+		return fmt.Errorf("handshake rejected: %w", err)
+	}
+	if challenge, ok := answer.(protocol.ChallengeMessage); ok {
+		err = c.authenticate(challenge)
 		if err != nil {
 			return err
 		}
-
-		err = c.sendBatch(batch)
+		answer, err = protocol.ReceiveAny(c.connReader)
 		if err != nil {
-			log.Error(common.FmtLog("send_batch", err))
-			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
-				return err
-			}
-		} else {
-			log.Info(common.FmtLog("send_batch", nil,
-				"batchSize", len(batch),
-			))
+			return fmt.Errorf("handshake rejected: %w", err)
+		}
+	}
+	switch answer := answer.(type) {
+	case protocol.OkMessage:
+	case protocol.ErrMessage:
+		return fmt.Errorf("handshake rejected: %w", answer)
+	default:
+		return fmt.Errorf("handshake rejected: unexpected code %v", answer.Code())
+	}
+
+	c.connReader.SetCodec(c.config.codec)
+	c.connWriter.SetCodec(c.config.codec)
+	c.connReader.SetCompression(c.config.compression)
+	return c.connWriter.SetCompression(c.config.compression)
+}
+
+// Proves to the server that the agency knows its secret
+func (c *client) authenticate(challenge protocol.ChallengeMessage) error {
+	if len(c.config.secret) == 0 {
+		return errors.New("the server requires authentication, but there is no secret")
+	}
+
+	return protocol.SendFlush(protocol.AuthMessage{
+		Mac: protocol.AuthMac(c.config.secret, challenge.Nonce, c.config.id),
+	}, c.connWriter)
+}
+
+// Connects to the server, retrying while the server is busy
+func (c *client) connect(ctx context.Context) error {
+	for {
+		err := c.createClientSocket(ctx)
+		retryAfter, ok := retryDelay(err)
+		if !ok {
+			return err
 		}
 
+		log.Warning(common.FmtLog("connect", err,
+			"retry_after", retryAfter,
+		))
+
 		select {
 		case <-ctx.Done():
 			return net.ErrClosed
-		case <-time.After(c.config.loopPeriod):
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+func (c *client) run(ctx context.Context) (err error) {
+	err = c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	closer := common.SpawnCloser(ctx, c.conn, closeSocket)
+	messages := c.receiveMessages()
+	defer func() {
+		closeErr := closer.Close()
+		err = errors.Join(err, closeErr)
+		// once the socket is closed, the receiver stops
+		for range messages {
+		}
+		c.logTraffic()
+	}()
+
+	if c.config.subscribe {
+		err = c.send(protocol.SubscribeMessage{})
+		if err != nil {
+			return err
 		}
 	}
 
-	err = protocol.SendFlush(protocol.FinishMessage{}, c.connWriter)
+	err = c.sendBatches(ctx, messages)
 	if err != nil {
 		return err
 	}
 
-	winners, err := protocol.Receive[protocol.WinnersMessage](c.connReader)
+	err = c.send(protocol.FinishMessage{})
+	if err != nil {
+		return err
+	}
+
+	winners, err := c.receiveWinners(ctx, messages)
 	if err != nil {
 		return err
 	} else {
@@ -115,57 +217,395 @@ func (c *client) run(ctx context.Context) (err error) {
 	return nil
 }
 
-func (c *client) sendBatch(bets []protocol.BetMessage) error {
-	err := protocol.SendFlush(protocol.BatchMessage{BatchSize: len(bets)}, c.connWriter)
+// A message received from the server, or the error that stopped the
+// receiver
+type received struct {
+	message protocol.Message
+	err     error
+}
+
+// Receives messages from the server in a separate goroutine, so that
+// batches can be sent while waiting for the answer of previous ones.
+// The channel is closed after the winners are received, or after the
+// first error.
+func (c *client) receiveMessages() <-chan received {
+	messages := make(chan received)
+
+	go func() {
+		defer close(messages)
+		for {
+			message, err := protocol.ReceiveAny(c.connReader)
+			messages <- received{message, err}
+			if err != nil {
+				return
+			}
+			if _, ok := message.(protocol.WinnersMessage); ok {
+				return
+			}
+		}
+	}()
+
+	return messages
+}
+
+// Sends every batch of the agency, without waiting for the answer of
+// previous batches, as long as there are less than `window` of them in
+// flight. Consecutive batches are sent at least `loopPeriod` apart, and
+// batches rejected with a retry delay are sent again once it elapses.
+func (c *client) sendBatches(ctx context.Context, messages <-chan received) error {
+	// batches that were not answered yet (or will be retried), by sequence number
+	pending := make(map[int][]protocol.BetMessage)
+	// position of the first bet of each pending batch in the agency file
+	firstBets := make(map[int]int)
+	nextBet := 1
+	// bets of each pending batch that the server did not store
+	rejected := make(map[int]map[int]bool)
+	// holds at most one sequence number per pending batch, so it never blocks
+	retries := make(chan int, c.config.window)
+	seq := 0
+	inFlight := 0
+	pinging := false
+	eof := false
+
+	period := time.NewTimer(0)
+	defer period.Stop()
+
+	var keepalive <-chan time.Time
+	if c.config.keepalivePeriod > 0 {
+		ticker := time.NewTicker(c.config.keepalivePeriod)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	for !eof || len(pending) > 0 {
+		var ready <-chan time.Time
+		if !eof && len(pending) < c.config.window {
+			ready = period.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return net.ErrClosed
+		case <-ready:
+			batch, err := c.readBatch()
+			if errors.Is(err, io.EOF) {
+				eof = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			seq++
+			pending[seq] = batch
+			firstBets[seq] = nextBet
+			nextBet += len(batch)
+			err = c.sendBatch(seq, batch)
+			if err != nil {
+				return err
+			}
+			inFlight++
+			period.Reset(c.config.loopPeriod)
+		case retry := <-retries:
+			err := c.sendBatch(retry, pending[retry])
+			if err != nil {
+				return err
+			}
+			inFlight++
+		case <-keepalive:
+			// while batches are in flight, their answers prove the server is alive
+			if inFlight > 0 || pinging {
+				break
+			}
+			err := c.send(protocol.PingMessage{})
+			if err != nil {
+				return err
+			}
+			pinging = true
+		case r, ok := <-messages:
+			if !ok {
+				return io.ErrUnexpectedEOF
+			}
+			if r.err != nil {
+				return r.err
+			}
+
+			switch message := r.message.(type) {
+			case protocol.AckMessage:
+				batch, ok := pending[message.Seq]
+				if !ok {
+					return fmt.Errorf("unexpected answer for batch %v", message.Seq)
+				}
+				err := c.storeReceipt(message, batch, rejected[message.Seq], firstBets[message.Seq])
+				if err != nil {
+					return err
+				}
+				delete(pending, message.Seq)
+				delete(firstBets, message.Seq)
+				inFlight--
+
+				log.Info(common.FmtLog("send_batch", nil,
+					"seq", message.Seq,
+					"batchSize", len(batch),
+					"rejected", len(rejected[message.Seq]),
+				))
+				delete(rejected, message.Seq)
+			case protocol.RejectedMessage:
+				batch, ok := pending[message.Seq]
+				if !ok || message.Index < 0 || message.Index >= len(batch) {
+					return fmt.Errorf("unexpected rejection of bet %v of batch %v", message.Index, message.Seq)
+				}
+				if rejected[message.Seq] == nil {
+					rejected[message.Seq] = make(map[int]bool)
+				}
+				rejected[message.Seq][message.Index] = true
+
+				// the rest of the batch is stored, the bet is not retried
+				log.Warning(common.FmtLog("reject_bet", nil,
+					"seq", message.Seq,
+					"index", message.Index,
+					"reason", message.Reason,
+					"bet", batch[message.Index],
+				))
+			case protocol.NackMessage:
+				batch, ok := pending[message.Seq]
+				if !ok {
+					return fmt.Errorf("unexpected answer for batch %v", message.Seq)
+				}
+				inFlight--
+				// a retried batch is answered from scratch
+				delete(rejected, message.Seq)
+
+				if message.RetryAfter <= 0 {
+					delete(pending, message.Seq)
+					delete(firstBets, message.Seq)
+					log.Error(common.FmtLog("send_batch", message,
+						"seq", message.Seq,
+						"batchSize", len(batch),
+					))
+					break
+				}
+
+				retryAfter := time.Duration(message.RetryAfter) * time.Millisecond
+				log.Warning(common.FmtLog("send_batch", message,
+					"seq", message.Seq,
+					"retry_after", retryAfter,
+				))
+				time.AfterFunc(retryAfter, func() {
+					retries <- message.Seq
+				})
+			case protocol.PongMessage:
+				pinging = false
+			case protocol.EventMessage:
+				logEvent(message)
+			default:
+				return fmt.Errorf("unexpected code %v", message.Code())
+			}
+		}
+
+		// while waiting for an answer, the server must send something
+		// within the timeout. Otherwise, it may stay silent.
+		timeout := time.Duration(0)
+		if inFlight > 0 || pinging {
+			timeout = c.config.ioTimeout
+		}
+		err := common.SetDeadline(c.conn.SetReadDeadline, timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the delay requested by the server, if the error can be retried
+func retryDelay(err error) (time.Duration, bool) {
+	var errMessage protocol.ErrMessage
+	if errors.As(err, &errMessage) && errMessage.RetryAfter > 0 {
+		return time.Duration(errMessage.RetryAfter) * time.Millisecond, true
+	}
+	return 0, false
+}
+
+// Checks the receipt of a batch against its stored bets and the server key, and stores it
+func (c *client) storeReceipt(ack protocol.AckMessage, batch []protocol.BetMessage, rejected map[int]bool, firstBet int) error {
+	receipt := protocol.Receipt{
+		RunId:     ack.RunId,
+		AgencyId:  c.config.id,
+		Seq:       ack.Seq,
+		Count:     ack.Count,
+		Hash:      ack.Hash,
+		Signature: ack.Signature,
+	}
+
+	// the receipt only covers the bets that were not rejected
+	stored := make([]protocol.BetMessage, 0, len(batch))
+	for i, bet := range batch {
+		if !rejected[i] {
+			stored = append(stored, bet)
+		}
+	}
+	if receipt.Count != len(stored) || receipt.Hash != protocol.HashBets(stored) {
+		return fmt.Errorf("receipt of batch %v does not match its bets", ack.Seq)
+	}
+	if c.config.serverKey != nil && !receipt.Verify(c.config.serverKey) {
+		return fmt.Errorf("receipt of batch %v has an invalid signature", ack.Seq)
+	}
+
+	return c.receipts.store(storedReceipt{
+		Receipt:  receipt,
+		FirstBet: firstBet,
+		LastBet:  firstBet + len(batch) - 1,
+	})
+}
+
+// Sends a batch, without waiting for its answer
+func (c *client) sendBatch(seq int, bets []protocol.BetMessage) error {
+	err := common.SetDeadline(c.conn.SetWriteDeadline, c.config.ioTimeout)
 	if err != nil {
 		return err
 	}
 
+	protocol.Send(protocol.BatchMessage{Seq: seq, BatchSize: len(bets)}, c.connWriter)
 	for _, bet := range bets {
 		protocol.Send(bet, c.connWriter)
 	}
-	err = protocol.Flush(c.connWriter)
-	if err != nil {
-		return err
+
+	return protocol.Flush(c.connWriter)
+}
+
+// Logs an event pushed by the server, so that it can be shown live
+func logEvent(event protocol.EventMessage) {
+	log.Info(common.FmtLog("event", nil,
+		"event", event.Event,
+	))
+}
+
+// Waits until the draw is done and receives the winners of the agency.
+// The server may probe the agency while waiting, and each probe is
+// answered immediately.
+func (c *client) receiveWinners(ctx context.Context, messages <-chan received) (protocol.WinnersMessage, error) {
+	for {
+		err := common.SetDeadline(c.conn.SetReadDeadline, c.config.idleTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		var r received
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return nil, net.ErrClosed
+		case r, ok = <-messages:
+		}
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		switch message := r.message.(type) {
+		case protocol.WinnersMessage:
+			return message, nil
+		case protocol.PingMessage:
+			err = c.send(protocol.PongMessage{})
+			if err != nil {
+				return nil, err
+			}
+		case protocol.PongMessage:
+			// answer to a probe sent before finishing
+		case protocol.EventMessage:
+			logEvent(message)
+		case protocol.ChainHeadMessage:
+			// identifies the bets of the draw, in case of a dispute
+			log.Info(common.FmtLog("chain_head", nil,
+				"head", message.Head,
+			))
+		default:
+			return nil, fmt.Errorf("expected code %v, got %v", protocol.WinnersCode, message.Code())
+		}
 	}
+}
 
-	_, err = protocol.Receive[protocol.OkMessage](c.connReader)
+// Sends and flushes a message, failing if it can't be written within
+// the configured timeout
+func (c *client) send(m protocol.Message) error {
+	err := common.SetDeadline(c.conn.SetWriteDeadline, c.config.ioTimeout)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return protocol.SendFlush(m, c.connWriter)
 }
 
-// Reads batch from agency data, with up to `c.config.batchSize` bets
+// Reads batch from agency data, with up to `c.config.batchSize` bets,
+// and up to `c.config.batchMaxBytes` bytes once encoded
 func (c *client) readBatch() ([]protocol.BetMessage, error) {
 	batch := make([]protocol.BetMessage, 0, c.config.batchSize)
+	size := c.headerSize
 
-	for i := 0; i < c.config.batchSize; i++ {
-		betRecord, err := c.betsReader.Read()
+	for len(batch) < c.config.batchSize {
+		bet, err := c.readBet()
 		if errors.Is(err, io.EOF) {
-			if len(batch) > 0 {
-				return batch, nil
-			} else {
-				return nil, io.EOF
-			}
+			break
 		}
 		if err != nil {
 			return nil, err
 		}
 
-		bet, err := protocol.Deserialize[protocol.BetMessage](betRecord)
-		if err != nil {
-			return nil, err
+		betSize := c.sizer.Size(bet)
+		if c.config.batchMaxBytes > 0 && size+betSize > c.config.batchMaxBytes {
+			if len(batch) == 0 {
+				return nil, fmt.Errorf("bet of %v bytes exceeds the batch budget of %v bytes", betSize, c.config.batchMaxBytes)
+			}
+			c.nextBet = &bet
+			break
 		}
 
+		size += betSize
 		batch = append(batch, bet)
 	}
 
+	if len(batch) == 0 {
+		return nil, io.EOF
+	}
+
 	return batch, nil
 }
 
-func closeSocket(c *net.TCPConn) error {
+// Reads the next bet from agency data, starting with the one that did
+// not fit in the previous batch
+func (c *client) readBet() (protocol.BetMessage, error) {
+	if c.nextBet != nil {
+		bet := *c.nextBet
+		c.nextBet = nil
+		return bet, nil
+	}
+
+	betRecord, err := c.betsReader.Read()
+	if err != nil {
+		return protocol.BetMessage{}, err
+	}
+
+	return protocol.Deserialize[protocol.BetMessage](betRecord)
+}
+
+// Logs the bytes exchanged with the server, before and after compression
+func (c *client) logTraffic() {
+	sent, sentWire := c.connWriter.Written()
+	received, receivedWire := c.connReader.Received()
+
+	log.Info(common.FmtLog("traffic", nil,
+		"compression", c.config.compression.Code(),
+		"bytes_sent", sent,
+		"bytes_sent_wire", sentWire,
+		"bytes_received", received,
+		"bytes_received_wire", receivedWire,
+	))
+}
+
+func closeSocket(c net.Conn) error {
 	err := c.Close()
 	if err != nil {
 		log.Error(common.FmtLog("close_connection", err))
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
+)
+
+// Creates a client connected in memory to a fake server, completing the
+// given config. Returns the connection of the server and the path of the
+// receipts.
+func newTestClient(t *testing.T, config clientConfig, bets []protocol.BetMessage) (*client, net.Conn, string) {
+	codec, err := protocol.LookupCodec(protocol.CsvCode)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	compression, err := protocol.LookupCompression(protocol.NoCompression)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	lines := make([]string, 0, len(bets))
+	for _, bet := range bets {
+		lines = append(lines, strings.Join(protocol.Serialize(bet), ",")+"\n")
+	}
+	betsReader := safeio.NewReader(strings.NewReader(strings.Join(lines, "")))
+
+	receiptsPath := filepath.Join(t.TempDir(), "receipts.csv")
+	receipts, err := openReceipts(receiptsPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() {
+		_ = receipts.Close()
+	})
+
+	config.id = 1
+	config.codec = codec
+	config.compression = compression
+	config.ioTimeout = time.Second
+	c := newClient(config, betsReader, receipts)
+
+	conn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = serverConn.Close()
+	})
+	c.conn = conn
+	c.connReader = protocol.NewReader(conn)
+	c.connWriter = protocol.NewWriter(conn)
+
+	return c, serverConn, receiptsPath
+}
+
+// Sends the batches of the client in the background, and returns the
+// result once they are all answered
+func sendTestBatches(c *client) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.sendBatches(context.Background(), c.receiveMessages())
+	}()
+	return done
+}
+
+// Receives a whole batch on the server side
+func receiveTestBatch(t *testing.T, reader *protocol.Reader) (int, []protocol.BetMessage) {
+	batch, err := protocol.Receive[protocol.BatchMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	bets := make([]protocol.BetMessage, 0, batch.BatchSize)
+	for i := 0; i < batch.BatchSize; i++ {
+		bet, err := protocol.Receive[protocol.BetMessage](reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		bets = append(bets, bet)
+	}
+	return batch.Seq, bets
+}
+
+// Acknowledges a batch with a receipt that covers all of its bets
+func ackTestBatch(writer *protocol.Writer, seq int, bets []protocol.BetMessage) {
+	_ = protocol.SendFlush(protocol.AckMessage{
+		Seq:   seq,
+		Count: len(bets),
+		Hash:  protocol.HashBets(bets),
+	}, writer)
+}
+
+func testBets(n int) []protocol.BetMessage {
+	bets := make([]protocol.BetMessage, 0, n)
+	for i := 0; i < n; i++ {
+		bets = append(bets, protocol.BetMessage{
+			FirstName: "Laura",
+			LastName:  "Lopez",
+			Document:  44160273 + i,
+			Birthdate: time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+			Number:    i,
+		})
+	}
+	return bets
+}
+
+func TestWindow(t *testing.T) {
+	bets := testBets(3)
+	c, serverConn, _ := newTestClient(t, clientConfig{batchSize: 1, window: 2}, bets)
+	reader := protocol.NewReader(serverConn)
+	writer := protocol.NewWriter(serverConn)
+	done := sendTestBatches(c)
+
+	// two batches are sent without waiting for an answer
+	for expected := 1; expected <= 2; expected++ {
+		seq, batch := receiveTestBatch(t, reader)
+		if seq != expected || len(batch) != 1 || batch[0] != bets[seq-1] {
+			t.Fatalf("expected batch %v, but got batch %v with %v", expected, seq, batch)
+		}
+	}
+
+	// the third one waits until the window has room
+	_ = serverConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := protocol.ReceiveAny(reader)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the window to be full, but got %v", err)
+	}
+	_ = serverConn.SetReadDeadline(time.Time{})
+
+	ackTestBatch(writer, 1, bets[0:1])
+	seq, batch := receiveTestBatch(t, reader)
+	if seq != 3 || batch[0] != bets[2] {
+		t.Fatalf("expected batch 3, but got batch %v with %v", seq, batch)
+	}
+
+	ackTestBatch(writer, 2, bets[1:2])
+	ackTestBatch(writer, 3, bets[2:3])
+	err = <-done
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestNackRetry(t *testing.T) {
+	bets := testBets(1)
+	c, serverConn, receiptsPath := newTestClient(t, clientConfig{batchSize: 1, window: 1}, bets)
+	reader := protocol.NewReader(serverConn)
+	writer := protocol.NewWriter(serverConn)
+	done := sendTestBatches(c)
+
+	receiveTestBatch(t, reader)
+	retryAfter := 100 * time.Millisecond
+	_ = protocol.SendFlush(protocol.NackMessage{
+		Seq:        1,
+		Reason:     protocol.BusyReason,
+		RetryAfter: int(retryAfter.Milliseconds()),
+	}, writer)
+	nacked := time.Now()
+
+	// the same batch is sent again, once the delay elapses
+	seq, batch := receiveTestBatch(t, reader)
+	if elapsed := time.Since(nacked); elapsed < retryAfter {
+		t.Fatalf("expected the batch to be retried after %v, but it was after %v", retryAfter, elapsed)
+	}
+	if seq != 1 || len(batch) != 1 || batch[0] != bets[0] {
+		t.Fatalf("expected batch 1 to be retried, but got batch %v with %v", seq, batch)
+	}
+
+	ackTestBatch(writer, 1, batch)
+	err := <-done
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	receipts, err := readReceipts(receiptsPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(receipts) != 1 || receipts[0].Seq != 1 {
+		t.Fatalf("expected a single receipt for batch 1, but got %v", receipts)
+	}
+}
+
+func TestOutOfOrderAcks(t *testing.T) {
+	bets := testBets(3)
+	c, serverConn, receiptsPath := newTestClient(t, clientConfig{batchSize: 1, window: 3}, bets)
+	reader := protocol.NewReader(serverConn)
+	writer := protocol.NewWriter(serverConn)
+	done := sendTestBatches(c)
+
+	batches := make(map[int][]protocol.BetMessage)
+	for i := 0; i < 3; i++ {
+		seq, batch := receiveTestBatch(t, reader)
+		batches[seq] = batch
+	}
+
+	// each answer is matched to its batch by sequence number
+	order := []int{3, 1, 2}
+	for _, seq := range order {
+		ackTestBatch(writer, seq, batches[seq])
+	}
+	err := <-done
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	receipts, err := readReceipts(receiptsPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(receipts) != len(order) {
+		t.Fatalf("expected %v receipts, but got %v", len(order), receipts)
+	}
+	for i, receipt := range receipts {
+		seq := order[i]
+		if receipt.Seq != seq || receipt.FirstBet != seq || receipt.LastBet != seq {
+			t.Fatalf("expected receipt %v to cover bet %v, but got %v", i, seq, receipt)
+		}
+	}
+}
+
+func TestReadBatchBudget(t *testing.T) {
+	bets := testBets(5)
+	codec, _ := protocol.LookupCodec(protocol.CsvCode)
+	sizer := protocol.NewSizer(codec)
+	header := sizer.Size(protocol.BatchMessage{Seq: math.MaxInt, BatchSize: 10})
+
+	// the budget fits two bets and the header, but not three
+	c, _, _ := newTestClient(t, clientConfig{
+		batchSize:     10,
+		batchMaxBytes: header + 2*sizer.Size(bets[0]) + 1,
+		window:        1,
+	}, bets)
+
+	for _, expected := range [][]protocol.BetMessage{bets[0:2], bets[2:4], bets[4:5]} {
+		batch, err := c.readBatch()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !slices.Equal(batch, expected) {
+			t.Fatalf("expected %v, but got %v", expected, batch)
+		}
+	}
+	_, err := c.readBatch()
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF, but got %v", err)
+	}
+
+	// a bet that does not fit on its own can't be sent
+	c, _, _ = newTestClient(t, clientConfig{
+		batchSize:     10,
+		batchMaxBytes: header + 1,
+		window:        1,
+	}, bets)
+	_, err = c.readBatch()
+	if err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("expected the bet to exceed the budget, but got %v", err)
+	}
+}
+
+func TestConnectRetriesBusy(t *testing.T) {
+	address, _ := transport.ParseAddress("pipe://client-busy")
+	listener, err := transport.Listen(context.Background(), net.ListenConfig{}, address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	c, _, _ := newTestClient(t, clientConfig{serverAddress: address, batchSize: 1, window: 1}, nil)
+	retryAfter := 100 * time.Millisecond
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- c.connect(context.Background())
+	}()
+
+	// the first attempt is refused, and the second one is admitted
+	answers := []protocol.Message{
+		protocol.ErrMessage{Reason: protocol.BusyReason, RetryAfter: int(retryAfter.Milliseconds())},
+		protocol.OkMessage{},
+	}
+	for _, answer := range answers {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		hello, err := protocol.Receive[protocol.HelloMessage](protocol.NewReader(conn))
+		if err != nil || hello.AgencyId != 1 {
+			t.Fatalf("expected the hello of agency 1, but got %v, %v", hello, err)
+		}
+		_ = protocol.SendFlush(answer, protocol.NewWriter(conn))
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if elapsed := time.Since(start); elapsed < retryAfter {
+		t.Fatalf("expected to reconnect after %v, but it was after %v", retryAfter, elapsed)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -12,7 +14,9 @@ import (
 	"time"
 
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
 	"github.com/mitchellh/mapstructure"
 	"github.com/op/go-logging"
 	"github.com/spf13/viper"
@@ -26,13 +30,40 @@ type config struct {
 		Address string
 	}
 	Log struct {
-		Level string
+		Level           string
+		RevealSensitive bool
 	}
 	Loop struct {
 		Period time.Duration
 	}
 	Batch struct {
 		MaxAmount int
+		MaxBytes  int
+		Window    int
+	}
+	Codec       string
+	Compression string
+	Timeout     struct {
+		Idle time.Duration
+		Io   time.Duration
+	}
+	Keepalive struct {
+		Period time.Duration
+	}
+	Events struct {
+		Subscribe bool
+	}
+	Tls struct {
+		Ca         string
+		Cert       string
+		Key        string
+		ServerName string
+	}
+	Auth struct {
+		Secret string
+	}
+	Receipts struct {
+		ServerKey string
 	}
 }
 
@@ -60,8 +91,24 @@ func logConfig(c config) {
 	log.Infof(common.FmtLog("config", nil,
 		"server.address", c.Server.Address,
 		"batch.maxAmount", c.Batch.MaxAmount,
+		"batch.maxBytes", c.Batch.MaxBytes,
+		"batch.window", c.Batch.Window,
 		"log.level", c.Log.Level,
+		"log.revealSensitive", c.Log.RevealSensitive,
 		"loop.period", c.Loop.Period,
+		"codec", c.Codec,
+		"compression", c.Compression,
+		"timeout.idle", c.Timeout.Idle,
+		"timeout.io", c.Timeout.Io,
+		"keepalive.period", c.Keepalive.Period,
+		"events.subscribe", c.Events.Subscribe,
+		"tls.ca", c.Tls.Ca,
+		"tls.cert", c.Tls.Cert,
+		"tls.key", c.Tls.Key,
+		"tls.serverName", c.Tls.ServerName,
+		// the secret is not logged
+		"auth.secret", c.Auth.Secret != "",
+		"receipts.serverKey", c.Receipts.ServerKey,
 	))
 }
 
@@ -75,9 +122,61 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to initialize logger: %v", err)
 	}
+	common.SetRevealSensitive(c.Log.RevealSensitive)
 
 	logConfig(c)
 
+	codec, err := protocol.LookupCodec(protocol.CodecCode(c.Codec))
+	if err != nil {
+		log.Fatalf("Failed to initialize codec: %v", err)
+	}
+
+	compression, err := protocol.LookupCompression(protocol.CompressionCode(c.Compression))
+	if err != nil {
+		log.Fatalf("Failed to initialize compression: %v", err)
+	}
+
+	serverAddress, err := transport.ParseAddress(c.Server.Address)
+	if err != nil {
+		log.Fatalf("Failed to parse server address: %v", err)
+	}
+
+	var tlsConfig *tls.Config
+	if c.Tls.Ca != "" {
+		// by default, the certificate must be valid for the server host
+		serverName := c.Tls.ServerName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(serverAddress.Address)
+		}
+
+		tlsConfig, err = transport.ClientTLS(c.Tls.Ca, c.Tls.Cert, c.Tls.Key, serverName)
+		if err != nil {
+			log.Fatalf("Failed to load tls config: %v", err)
+		}
+	}
+
+	var serverKey ed25519.PublicKey
+	if c.Receipts.ServerKey != "" {
+		serverKey, err = loadServerKey(c.Receipts.ServerKey)
+		if err != nil {
+			log.Fatalf("Failed to load server key: %v", err)
+		}
+	}
+
+	receiptsPath := fmt.Sprintf(".data/receipts-%v.csv", c.Id)
+
+	// `client receipts` verifies the stored receipts, instead of sending bets
+	if len(os.Args) > 1 && os.Args[1] == "receipts" {
+		if serverKey == nil {
+			log.Fatalf("Failed to verify receipts: receipts.serverKey is not configured")
+		}
+		err = verifyReceipts(receiptsPath, serverKey)
+		if err != nil {
+			log.Fatalf("Failed to verify receipts: %v", err)
+		}
+		return
+	}
+
 	betsPath := fmt.Sprintf(".data/agency-%v.csv", c.Id)
 	betsFile, err := os.Open(betsPath)
 	if err != nil {
@@ -85,13 +184,31 @@ func main() {
 	}
 	betsReader := safeio.NewReader(betsFile)
 
+	receipts, err := openReceipts(receiptsPath)
+	if err != nil {
+		log.Fatalf("Failed to open receipts: %v", err)
+	}
+	defer receipts.Close()
+
 	clientConfig := clientConfig{
-		serverAddress: c.Server.Address,
-		batchSize:     c.Batch.MaxAmount,
-		id:            c.Id,
-		loopPeriod:    c.Loop.Period,
+		serverAddress:   serverAddress,
+		batchSize:       c.Batch.MaxAmount,
+		id:              c.Id,
+		loopPeriod:      c.Loop.Period,
+		codec:           codec,
+		compression:     compression,
+		idleTimeout:     c.Timeout.Idle,
+		ioTimeout:       c.Timeout.Io,
+		keepalivePeriod: c.Keepalive.Period,
+		// at least one batch must be in flight to make progress
+		window:        max(c.Batch.Window, 1),
+		batchMaxBytes: c.Batch.MaxBytes,
+		subscribe:     c.Events.Subscribe,
+		tls:           tlsConfig,
+		secret:        []byte(c.Auth.Secret),
+		serverKey:     serverKey,
 	}
-	client := newClient(clientConfig, betsReader)
+	client := newClient(clientConfig, betsReader, receipts)
 
 	ctx, ctx_cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM)
 	defer ctx_cancel()
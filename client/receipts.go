@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+// Appends the receipts of the stored batches to a CSV file, so that the
+// agency can present them later. Each receipt is synced to disk before
+// the batch is considered sent.
+type receiptWriter struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+// A receipt, with the bets of the agency file that it covers, so that it
+// can be tied to them in a dispute
+type storedReceipt struct {
+	protocol.Receipt
+	// position of the first and last bets of the batch in the agency
+	// file, starting from one
+	FirstBet int
+	LastBet  int
+}
+
+const RECEIPT_FIELDS = 8
+
+func openReceipts(path string) (*receiptWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &receiptWriter{file: file, writer: csv.NewWriter(file)}, nil
+}
+
+func (w *receiptWriter) store(receipt storedReceipt) error {
+	err := w.writer.Write([]string{
+		receipt.RunId,
+		strconv.Itoa(receipt.AgencyId),
+		strconv.Itoa(receipt.Seq),
+		strconv.Itoa(receipt.Count),
+		receipt.Hash,
+		receipt.Signature,
+		strconv.Itoa(receipt.FirstBet),
+		strconv.Itoa(receipt.LastBet),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.writer.Flush()
+	err = w.writer.Error()
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *receiptWriter) Close() error {
+	return w.file.Close()
+}
+
+// Reads every receipt stored by `receiptWriter`
+func readReceipts(path string) ([]storedReceipt, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = RECEIPT_FIELDS
+
+	receipts := make([]storedReceipt, 0)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return receipts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// every field but the run id, hash and signature is a number
+		var fields [RECEIPT_FIELDS]int
+		for _, i := range []int{1, 2, 3, 6, 7} {
+			fields[i], err = strconv.Atoi(record[i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid receipt %v: %w", record, err)
+			}
+		}
+
+		receipts = append(receipts, storedReceipt{
+			Receipt: protocol.Receipt{
+				RunId:     record[0],
+				AgencyId:  fields[1],
+				Seq:       fields[2],
+				Count:     fields[3],
+				Hash:      record[4],
+				Signature: record[5],
+			},
+			FirstBet: fields[6],
+			LastBet:  fields[7],
+		})
+	}
+}
+
+// Loads the public key of the server, which signs the receipts, from a
+// PKIX PEM file
+func loadServerKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%v is not a PEM file", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ed25519Key, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%v is not an Ed25519 key", path)
+	}
+
+	return ed25519Key, nil
+}
+
+// Verifies every stored receipt with the key of the server, so that they
+// can be presented in a dispute. Fails if any of them is invalid.
+func verifyReceipts(path string, serverKey ed25519.PublicKey) error {
+	receipts, err := readReceipts(path)
+	if err != nil {
+		return err
+	}
+
+	invalid := 0
+	bets := 0
+	for _, receipt := range receipts {
+		if !receipt.Verify(serverKey) {
+			invalid++
+			log.Warning(common.FmtLog("verify_receipt", errors.New("invalid signature"),
+				"run_id", receipt.RunId,
+				"agency_id", receipt.AgencyId,
+				"seq", receipt.Seq,
+				"count", receipt.Count,
+				"hash", receipt.Hash,
+				"first_bet", receipt.FirstBet,
+				"last_bet", receipt.LastBet,
+			))
+			continue
+		}
+
+		bets += receipt.Count
+		log.Info(common.FmtLog("verify_receipt", nil,
+			"run_id", receipt.RunId,
+			"agency_id", receipt.AgencyId,
+			"seq", receipt.Seq,
+			"count", receipt.Count,
+			"hash", receipt.Hash,
+			"first_bet", receipt.FirstBet,
+			"last_bet", receipt.LastBet,
+		))
+	}
+
+	log.Info(common.FmtLog("verify_receipts", nil,
+		"receipts", len(receipts),
+		"invalid", invalid,
+		"bets", bets,
+	))
+
+	if invalid > 0 {
+		return fmt.Errorf("%v of %v receipts are invalid", invalid, len(receipts))
+	}
+	return nil
+}
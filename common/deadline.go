@@ -0,0 +1,15 @@
+package common
+
+import (
+	"time"
+)
+
+// Sets a connection deadline `timeout` from now, with the given setter
+// (for example, `conn.SetReadDeadline`). A zero timeout removes the
+// deadline instead.
+func SetDeadline(setter func(time.Time) error, timeout time.Duration) error {
+	if timeout == 0 {
+		return setter(time.Time{})
+	}
+	return setter(time.Now().Add(timeout))
+}
@@ -29,6 +29,8 @@ func InitLogger(logLevel string) error {
 	return nil
 }
 
+// Formats a log line with the result of the action, followed by the
+// key/value pairs of `data`. Sensitive values are redacted (see `Redactable`).
 func FmtLog(action string, err error, data ...any) string {
 	listed := make([]string, 0)
 
@@ -42,7 +44,7 @@ func FmtLog(action string, err error, data ...any) string {
 	}
 
 	for len(data) >= 2 {
-		listed = append(listed, fmt.Sprintf("%v: %v", data[0], data[1]))
+		listed = append(listed, fmt.Sprintf("%v: %v", data[0], redact(data[0], data[1])))
 		data = data[2:]
 	}
 
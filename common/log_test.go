@@ -0,0 +1,91 @@
+package common_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+func TestFmtLogRedacts(t *testing.T) {
+	bet := protocol.BetMessage{
+		FirstName: "Laura",
+		LastName:  "Lopez",
+		Document:  44160273,
+		Birthdate: time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		Number:    7574,
+	}
+
+	line := common.FmtLog("apuesta_enviada", nil,
+		"dni", bet.Document,
+		"bet.first_name", bet.FirstName,
+		"Birthdate", bet.Birthdate,
+		"bet", bet,
+		"numero", bet.Number,
+	)
+
+	for _, sensitive := range []string{"Laura", "Lopez", "44160273", "2002"} {
+		if strings.Contains(line, sensitive) {
+			t.Fatalf("expected %q to be redacted, but got %q", sensitive, line)
+		}
+	}
+	if !strings.Contains(line, "numero: 7574") {
+		t.Fatalf("expected the bet number to be logged, but got %q", line)
+	}
+
+	// the same document is always hashed the same way
+	hash := common.HashSensitive(bet.Document)
+	if strings.Count(line, hash) != 2 {
+		t.Fatalf("expected the document to be hashed as %v, but got %q", hash, line)
+	}
+}
+
+func TestFmtLogReveals(t *testing.T) {
+	common.SetRevealSensitive(true)
+	defer common.SetRevealSensitive(false)
+
+	line := common.FmtLog("apuesta_enviada", nil,
+		"dni", 44160273,
+		"nombre", "Laura",
+	)
+	if line != "action: apuesta_enviada | result: success | dni: 44160273 | nombre: Laura" {
+		t.Fatalf("expected sensitive values to be revealed, but got %q", line)
+	}
+}
+
+func TestFmtLogRedactsNested(t *testing.T) {
+	bets := []protocol.BetMessage{
+		{
+			FirstName: "Laura",
+			LastName:  "Lopez",
+			Document:  44160273,
+			Birthdate: time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+			Number:    7574,
+		},
+		{
+			FirstName: "Pedro",
+			LastName:  "Perez",
+			Document:  30904465,
+			Birthdate: time.Date(1999, time.March, 17, 0, 0, 0, 0, time.UTC),
+			Number:    8134,
+		},
+	}
+
+	line := common.FmtLog("apuestas", nil,
+		"batch", bets,
+		"by_seq", map[int][]protocol.BetMessage{1: bets},
+		"first", &bets[0],
+		"numbers", []int{7574, 8134},
+	)
+
+	for _, sensitive := range []string{"Laura", "Lopez", "44160273", "2002", "Pedro", "Perez", "30904465", "1999"} {
+		if strings.Contains(line, sensitive) {
+			t.Fatalf("expected %q to be redacted, but got %q", sensitive, line)
+		}
+	}
+	if !strings.Contains(line, "numbers: [7574 8134]") || !strings.Contains(line, "8134}]") {
+		t.Fatalf("expected the bet numbers to be logged, but got %q", line)
+	}
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+// Logs must not expose the personal data of bettors, so `FmtLog` redacts
+// the values of sensitive keys, and values that implement `Redactable`,
+// even within slices, arrays, maps and pointers.
+// Documents are replaced by a keyed hash, so that the lines of the same
+// bettor can still be correlated within a run, while names and birthdates
+// are masked. In development, `SetRevealSensitive` disables it.
+
+// Replaces masked values
+const MASK = "***"
+
+// Implemented by values with sensitive fields, such as bets
+type Redactable interface {
+	// Returns the value without its sensitive fields
+	Redact() any
+}
+
+type sensitivity int
+
+const (
+	masked sensitivity = iota + 1
+	hashed
+)
+
+// Sensitive keys, compared in lowercase, ignoring any `prefix.`
+var sensitiveKeys = map[string]sensitivity{
+	"document":   hashed,
+	"documento":  hashed,
+	"dni":        hashed,
+	"name":       masked,
+	"first_name": masked,
+	"last_name":  masked,
+	"nombre":     masked,
+	"apellido":   masked,
+	"birthdate":  masked,
+	"nacimiento": masked,
+}
+
+var revealSensitive atomic.Bool
+
+// Keys the hash of sensitive values, so that they can't be brute forced
+// from the logs. It changes on each run.
+var redactionKey = func() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}()
+
+// Logs sensitive values as they are, only meant for development
+func SetRevealSensitive(reveal bool) {
+	revealSensitive.Store(reveal)
+}
+
+// Returns a short keyed hash of the value, for logging
+func HashSensitive(value any) string {
+	mac := hmac.New(sha256.New, redactionKey)
+	mac.Write([]byte(fmt.Sprint(value)))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// Returns the value to log for the key
+func redact(key any, value any) any {
+	if revealSensitive.Load() {
+		return value
+	}
+
+	if redacted, ok := redactNested(value); ok {
+		return redacted
+	}
+
+	name := strings.ToLower(fmt.Sprint(key))
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	switch sensitiveKeys[name] {
+	case masked:
+		return MASK
+	case hashed:
+		return HashSensitive(value)
+	default:
+		return value
+	}
+}
+
+// Redacts the `Redactable` values within the value. Returns false if
+// there are none, so that the value is logged as it is.
+func redactNested(value any) (any, bool) {
+	if redactable, ok := value.(Redactable); ok {
+		return redactable.Redact(), true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return value, false
+		}
+		return redactNested(v.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		if plain(v.Type().Elem()) {
+			return value, false
+		}
+		items := make([]any, v.Len())
+		found := false
+		for i := range items {
+			item, ok := redactNested(v.Index(i).Interface())
+			items[i] = item
+			found = found || ok
+		}
+		return items, found
+	case reflect.Map:
+		if plain(v.Type().Key()) && plain(v.Type().Elem()) {
+			return value, false
+		}
+		entries := make(map[any]any, v.Len())
+		found := false
+		iter := v.MapRange()
+		for iter.Next() {
+			key, keyOk := redactNested(iter.Key().Interface())
+			item, itemOk := redactNested(iter.Value().Interface())
+			entries[key] = item
+			found = found || keyOk || itemOk
+		}
+		return entries, found
+	default:
+		return value, false
+	}
+}
+
+// Returns true if values of the type can't hold a `Redactable`, such as
+// the bytes of a slice
+func plain(ty reflect.Type) bool {
+	if ty.Implements(reflect.TypeFor[Redactable]()) {
+		return false
+	}
+	kind := ty.Kind()
+	return kind <= reflect.Complex128 || kind == reflect.String
+}
@@ -0,0 +1,44 @@
+#!/bin/sh
+
+if [ "$#" -ne 2 ]; then
+  echo "Generates a development CA, a server certificate, and a certificate for each agency"
+  echo
+  echo "Usage: $0 <output dir> <clients>"
+  exit 1
+fi
+OUTPUT=$1
+CLIENTS=$2
+
+# validate $CLIENTS is a number
+if ! [ "$CLIENTS" -eq "$CLIENTS" ] 2>/dev/null; then
+  echo "$CLIENTS is not a number"
+  exit 1
+fi
+
+set -e
+mkdir -p "$OUTPUT"
+
+# signs a certificate for the given name with the CA
+# usage: sign <name> <common name> <extensions>
+sign() {
+  openssl req -new -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes \
+    -keyout "$OUTPUT/$1.key" -out "$OUTPUT/$1.csr" -subj "/CN=$2" 2>/dev/null
+  printf "%s\n" "$3" > "$OUTPUT/$1.ext"
+  openssl x509 -req -in "$OUTPUT/$1.csr" -CA "$OUTPUT/ca.crt" -CAkey "$OUTPUT/ca.key" \
+    -CAcreateserial -days 365 -sha256 -extfile "$OUTPUT/$1.ext" -out "$OUTPUT/$1.crt" 2>/dev/null
+  rm "$OUTPUT/$1.csr" "$OUTPUT/$1.ext"
+}
+
+openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes \
+  -keyout "$OUTPUT/ca.key" -out "$OUTPUT/ca.crt" -days 365 -subj "/CN=tp0-dev-ca" 2>/dev/null
+
+sign server server "subjectAltName=DNS:server,DNS:localhost,IP:127.0.0.1
+extendedKeyUsage=serverAuth"
+
+# the common name identifies the agency, see `AGENCY_CERT_PREFIX`
+for i in $(seq 1 "$CLIENTS"); do
+  sign "agency-$i" "agency-$i" "extendedKeyUsage=clientAuth"
+done
+
+rm -f "$OUTPUT/ca.srl"
+echo "Certificates written to $OUTPUT"
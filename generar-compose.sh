@@ -30,6 +30,7 @@ append "    image: server:latest"
 append "    entrypoint: /server"
 append "    volumes:"
 append "      - ./server/config.ini:/config.ini"
+append "      - ./certs:/certs"
 append "    networks:"
 append "      - testing_net"
 append ""
@@ -41,9 +42,12 @@ append "    image: client:latest"
 append "    entrypoint: /client"
 append "    environment:"
 append "      - CLI_ID=$i"
+append "      - CLI_TLS_CERT=/certs/agency-$i.crt"
+append "      - CLI_TLS_KEY=/certs/agency-$i.key"
 append "    volumes:"
 append "      - ./client/config.yaml:/config.yaml"
 append "      - ./client/.data:/.data"
+append "      - ./certs:/certs"
 append "    networks:"
 append "      - testing_net"
 append "    depends_on:"
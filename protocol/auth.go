@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// Size in bytes of the nonce of `ChallengeMessage`
+const NONCE_SIZE = 16
+
+// Generates a random nonce for `ChallengeMessage`, hex encoded
+func NewNonce() (string, error) {
+	nonce := make([]byte, NONCE_SIZE)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// Computes the answer to a challenge: the HMAC-SHA256 of the nonce and
+// the agency id (separated by a comma), keyed with the secret of the
+// agency, hex encoded
+func AuthMac(secret []byte, nonce string, agencyId int) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{','})
+	mac.Write([]byte(strconv.Itoa(agencyId)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the answer to a challenge in constant time
+func VerifyAuthMac(secret []byte, nonce string, agencyId int, answer string) bool {
+	expected := AuthMac(secret, nonce, agencyId)
+	return hmac.Equal([]byte(expected), []byte(answer))
+}
@@ -0,0 +1,62 @@
+package protocol_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+func TestNewNonce(t *testing.T) {
+	first, err := protocol.NewNonce()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	second, err := protocol.NewNonce()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	decoded, err := hex.DecodeString(first)
+	if err != nil {
+		t.Fatalf("nonce is not hex: %v", err)
+	}
+	if len(decoded) != protocol.NONCE_SIZE {
+		t.Fatalf("expected %v bytes, got %v", protocol.NONCE_SIZE, len(decoded))
+	}
+	if first == second {
+		t.Fatalf("nonces are repeated: %v", first)
+	}
+}
+
+func TestAuthMac(t *testing.T) {
+	secret := []byte("secreto")
+	nonce := "000102030405060708090a0b0c0d0e0f"
+	mac := protocol.AuthMac(secret, nonce, 1)
+
+	// same as the auth golden vector
+	expected := "568c18600157a9b79000891d1f517dbee833acac44e999e2a27894c809cb6040"
+	if mac != expected {
+		t.Fatalf("expected %v, got %v", expected, mac)
+	}
+
+	if !protocol.VerifyAuthMac(secret, nonce, 1, mac) {
+		t.Fatalf("valid mac was rejected")
+	}
+
+	invalid := []struct {
+		name     string
+		secret   []byte
+		nonce    string
+		agencyId int
+	}{
+		{"other secret", []byte("otro"), nonce, 1},
+		{"other nonce", secret, "0f0e0d0c0b0a09080706050403020100", 1},
+		{"other agency", secret, nonce, 2},
+	}
+	for _, c := range invalid {
+		if protocol.VerifyAuthMac(c.secret, c.nonce, c.agencyId, mac) {
+			t.Errorf("%v: invalid mac was accepted", c.name)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+)
+
+// Encodes each message as a length prefixed binary frame. The frame
+// starts with the message code, followed by the fields of the message:
+// - Ints are encoded as (zig-zag) varints.
+// - Strings are prefixed by their length, encoded as a varint.
+// - Dates are encoded as the number of days since the Unix epoch.
+// - Slices are prefixed by their length, followed by each element.
+//
+// As most of the values are small numbers or short strings, each bet
+// takes about two thirds of the space it takes with the CSV codec, so more
+// bets fit in a single packet.
+type binaryCodec struct{}
+
+// Upper bound of a frame size, to avoid allocating arbitrarily large
+// buffers when receiving a malformed frame.
+const binaryMaxFrameSize = 1 << 20
+
+const secondsPerDay = 24 * 60 * 60
+
+func (binaryCodec) Code() CodecCode {
+	return BinaryCode
+}
+
+func (binaryCodec) encode(m Message, w *safeio.Writer) {
+	payload := appendBinaryString(nil, string(m.Code()))
+	payload = appendBinaryValue(payload, reflect.ValueOf(m))
+
+	frame := binary.AppendUvarint(nil, uint64(len(payload)))
+	frame = append(frame, payload...)
+
+	w.WriteBytes(frame)
+}
+
+func (binaryCodec) decode(r *safeio.Reader) (Message, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > binaryMaxFrameSize {
+		return nil, fmt.Errorf("frame size %v exceeds limit", size)
+	}
+
+	payload, err := r.ReadFull(int(size))
+	if err != nil {
+		return nil, err
+	}
+
+	d := binaryDecoder{payload}
+	code, err := d.string()
+	if err != nil {
+		return nil, fmt.Errorf("message code is missing")
+	}
+
+	ty, err := lookup(MessageCode(code), []string{hex.EncodeToString(payload)})
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := d.value(ty)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.data) > 0 {
+		return nil, fmt.Errorf("frame has %v trailing bytes", len(d.data))
+	}
+
+	return value.Interface().(Message), nil
+}
+
+// Appends the binary representation of a struct or slice value
+func appendBinaryValue(data []byte, value reflect.Value) []byte {
+	switch value.Kind() {
+	case reflect.Struct:
+		fields := reflect.VisibleFields(value.Type())
+		for _, fieldTy := range fields {
+			field := value.FieldByIndex(fieldTy.Index)
+			data = appendBinaryPrimitive(data, field)
+		}
+	case reflect.Slice:
+		data = binary.AppendUvarint(data, uint64(value.Len()))
+		value.Seq2()(func(_, element reflect.Value) bool {
+			data = appendBinaryPrimitive(data, element)
+			return true
+		})
+	default:
+		log.Panicf("unimplemented: serialization of type %v", value.Kind())
+	}
+
+	return data
+}
+
+func appendBinaryPrimitive(data []byte, value reflect.Value) []byte {
+	if date, ok := value.Interface().(time.Time); ok {
+		return binary.AppendVarint(data, date.Unix()/secondsPerDay)
+	}
+
+	switch value.Kind() {
+	case reflect.Int:
+		return binary.AppendVarint(data, value.Int())
+	case reflect.String:
+		return appendBinaryString(data, value.String())
+	default:
+		log.Panicf("unimplemented: serialization of type %v", value.Type())
+	}
+
+	return nil
+}
+
+func appendBinaryString(data []byte, value string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+// Consumes a binary payload from front to back
+type binaryDecoder struct {
+	data []byte
+}
+
+// Decodes a struct or slice value of type `ty`
+func (d *binaryDecoder) value(ty reflect.Type) (reflect.Value, error) {
+	value := reflect.New(ty).Elem()
+
+	switch ty.Kind() {
+	case reflect.Struct:
+		fields := reflect.VisibleFields(ty)
+		for _, fieldTy := range fields {
+			if len(d.data) == 0 && optional(fieldTy) {
+				value.FieldByIndex(fieldTy.Index).Set(defaultValue(fieldTy))
+				continue
+			}
+			fieldValue, err := d.primitive(fieldTy.Type)
+			if err != nil {
+				return value, fmt.Errorf("field %v %w", fieldTy.Name, err)
+			}
+			value.FieldByIndex(fieldTy.Index).Set(fieldValue)
+		}
+	case reflect.Slice:
+		length, err := d.uvarint()
+		if err != nil || length > uint64(len(d.data)) {
+			return value, fmt.Errorf("slice length is invalid")
+		}
+
+		value.Set(reflect.MakeSlice(ty, int(length), int(length)))
+		for i := 0; i < int(length); i++ {
+			elemValue, err := d.primitive(ty.Elem())
+			if err != nil {
+				return value, fmt.Errorf("element %v %w", i, err)
+			}
+			value.Index(i).Set(elemValue)
+		}
+	default:
+		log.Panicf("unimplemented: deserialization of type %v", ty.Kind())
+	}
+
+	return value, nil
+}
+
+func (d *binaryDecoder) primitive(ty reflect.Type) (reflect.Value, error) {
+	value := reflect.New(ty).Elem()
+
+	if ty == reflect.TypeFor[time.Time]() {
+		days, err := d.varint()
+		if err != nil {
+			return value, fmt.Errorf("should be a date")
+		}
+		value.Set(reflect.ValueOf(time.Unix(days*secondsPerDay, 0).UTC()))
+		return value, nil
+	}
+
+	switch ty.Kind() {
+	case reflect.Int:
+		valueToSet, err := d.varint()
+		if err != nil {
+			return value, fmt.Errorf("should be an int")
+		}
+		value.SetInt(valueToSet)
+	case reflect.String:
+		valueToSet, err := d.string()
+		if err != nil {
+			return value, fmt.Errorf("should be a string")
+		}
+		value.SetString(valueToSet)
+	default:
+		log.Panicf("unimplemented: deserialization of type %v", ty)
+	}
+
+	return value, nil
+}
+
+func (d *binaryDecoder) varint() (int64, error) {
+	value, n := binary.Varint(d.data)
+	if n <= 0 {
+		return 0, fmt.Errorf("malformed varint")
+	}
+	d.data = d.data[n:]
+	return value, nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	value, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		return 0, fmt.Errorf("malformed varint")
+	}
+	d.data = d.data[n:]
+	return value, nil
+}
+
+func (d *binaryDecoder) string() (string, error) {
+	length, err := d.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(len(d.data)) {
+		return "", fmt.Errorf("string is truncated")
+	}
+
+	value := string(d.data[:length])
+	d.data = d.data[length:]
+	return value, nil
+}
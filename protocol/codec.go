@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+)
+
+// A codec defines how messages are represented on the wire. Each
+// connection starts with the CSV codec, and may switch to another one
+// after the handshake (see `HelloMessage`).
+
+type CodecCode string
+
+const (
+	CsvCode    CodecCode = "CSV"
+	JsonCode   CodecCode = "JSON"
+	BinaryCode CodecCode = "BINARY"
+)
+
+type Codec interface {
+	Code() CodecCode
+	// Buffers the encoded message in the writer
+	encode(m Message, w *safeio.Writer)
+	// Reads and decodes the next message from the reader
+	decode(r *safeio.Reader) (Message, error)
+}
+
+var codecs = map[CodecCode]Codec{
+	CsvCode:    csvCodec{},
+	JsonCode:   jsonCodec{},
+	BinaryCode: binaryCodec{},
+}
+
+// Returns the codec identified by the given code
+func LookupCodec(code CodecCode) (Codec, error) {
+	codec, ok := codecs[code]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", code)
+	}
+	return codec, nil
+}
+
+// Measures the size of encoded messages, before compression. The buffer
+// is reused between messages, so it should be kept around.
+type Sizer struct {
+	codec   Codec
+	counter *countingWriter
+	buf     *safeio.Writer
+}
+
+func NewSizer(codec Codec) *Sizer {
+	counter := &countingWriter{w: io.Discard}
+
+	return &Sizer{
+		codec:   codec,
+		counter: counter,
+		buf:     safeio.NewWriter(counter),
+	}
+}
+
+// Returns the amount of bytes the message takes on the wire
+func (s *Sizer) Size(m Message) int {
+	before := s.counter.count
+	s.codec.encode(m, s.buf)
+	_ = s.buf.Flush()
+
+	return int(s.counter.count - before)
+}
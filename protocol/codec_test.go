@@ -0,0 +1,212 @@
+package protocol_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+)
+
+var codecCodes = []protocol.CodecCode{
+	protocol.CsvCode,
+	protocol.JsonCode,
+	protocol.BinaryCode,
+}
+
+func TestCodecs(t *testing.T) {
+	messages := []protocol.Message{
+		protocol.HelloMessage{83, protocol.JsonCode, protocol.FlateCompression},
+		protocol.BatchMessage{83, 3},
+		protocol.BetMessage{
+			"Laura",
+			"Lopez",
+			44160273,
+			time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+			83,
+		},
+		protocol.OkMessage{},
+		protocol.ErrMessage{protocol.BusyReason, 1000},
+		protocol.AckMessage{3, "0f0e", 83, "00ff", "ff00"},
+		protocol.NackMessage{3, protocol.StorageReason, 0},
+		protocol.RejectedMessage{3, 82, protocol.DuplicateReason},
+		protocol.FinishMessage{},
+		protocol.WinnersMessage{1, 2, 3},
+		protocol.WinnersMessage{},
+		protocol.AgencyBatchMessage{3, 1, 83},
+		protocol.AgencyFinishMessage{3},
+		protocol.AgencyWinnersMessage{3},
+		protocol.SubscribeMessage{},
+		protocol.EventMessage{protocol.ClosingSoonEvent},
+		protocol.ChallengeMessage{"000102030405060708090a0b0c0d0e0f"},
+		protocol.AuthMessage{"00ff"},
+		protocol.ChainHeadMessage{"ff00"},
+	}
+
+	for _, code := range codecCodes {
+		codec, err := protocol.LookupCodec(code)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		var buf bytes.Buffer
+		writer := protocol.NewWriter(&buf)
+		writer.SetCodec(codec)
+		reader := protocol.NewReader(&buf)
+		reader.SetCodec(codec)
+
+		for _, message := range messages {
+			protocol.Send(message, writer)
+		}
+		_ = protocol.Flush(writer)
+
+		for _, message := range messages {
+			received, err := protocol.ReceiveAny(reader)
+			if err != nil {
+				t.Fatalf("%v: %v", code, err)
+			}
+
+			if !reflect.DeepEqual(received, message) {
+				t.Fatalf("%v: %#v, %#v", code, received, message)
+			}
+		}
+	}
+}
+
+func TestSizer(t *testing.T) {
+	messages := []protocol.Message{
+		protocol.BatchMessage{83, 3},
+		protocol.BetMessage{
+			"José María",
+			"Muñoz Ñandú",
+			30904465,
+			time.Date(1999, time.March, 17, 0, 0, 0, 0, time.UTC),
+			1,
+		},
+		protocol.WinnersMessage{1, 2, 3},
+	}
+
+	for _, code := range codecCodes {
+		codec, _ := protocol.LookupCodec(code)
+		sizer := protocol.NewSizer(codec)
+
+		for _, message := range messages {
+			var buf bytes.Buffer
+			writer := protocol.NewWriter(&buf)
+			writer.SetCodec(codec)
+			_ = protocol.SendFlush(message, writer)
+
+			size := sizer.Size(message)
+			if size != buf.Len() {
+				t.Fatalf("%v: expected size %v, but got %v", code, buf.Len(), size)
+			}
+		}
+	}
+}
+
+// Path to the dataset provided with the client
+const datasetPath = "../client/.data/dataset.zip"
+
+// Loads the bets of the first agency of the provided dataset
+func loadDataset(b *testing.B) []protocol.BetMessage {
+	archive, err := zip.OpenReader(datasetPath)
+	if err != nil {
+		b.Skipf("dataset not available: %v", err)
+	}
+	defer archive.Close()
+
+	file, err := archive.Open("agency-1.csv")
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer file.Close()
+
+	reader := safeio.NewReader(file)
+	bets := make([]protocol.BetMessage, 0)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			b.Fatalf("%v", err)
+		}
+
+		bet, err := protocol.Deserialize[protocol.BetMessage](record)
+		if err != nil {
+			b.Fatalf("%v", err)
+		}
+		bets = append(bets, bet)
+	}
+
+	return bets
+}
+
+// Compares the throughput of each codec when sending and receiving the
+// bets of an agency. Also reports the average encoded size of a bet.
+func BenchmarkCodecs(b *testing.B) {
+	bets := loadDataset(b)
+
+	for _, code := range codecCodes {
+		codec, _ := protocol.LookupCodec(code)
+
+		b.Run(string(code), func(b *testing.B) {
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				writer := protocol.NewWriter(&buf)
+				writer.SetCodec(codec)
+				for _, bet := range bets {
+					protocol.Send(bet, writer)
+				}
+				_ = protocol.Flush(writer)
+				size := buf.Len()
+
+				reader := protocol.NewReader(&buf)
+				reader.SetCodec(codec)
+				for range bets {
+					_, err := protocol.Receive[protocol.BetMessage](reader)
+					if err != nil {
+						b.Fatalf("%v", err)
+					}
+				}
+
+				b.ReportMetric(float64(size)/float64(len(bets)), "bytes/bet")
+			}
+			b.ReportMetric(float64(len(bets)*b.N)/b.Elapsed().Seconds(), "bets/s")
+		})
+	}
+}
+
+// Trailing fields with a default may be omitted, with any codec
+func TestOptionalFields(t *testing.T) {
+	frames := map[protocol.CodecCode][]byte{
+		protocol.CsvCode:  []byte("HELLO,1\n"),
+		protocol.JsonCode: []byte(`{"type":"HELLO","AgencyId":1}` + "\n"),
+		// frame size, then the length prefixed code and the agency varint
+		protocol.BinaryCode: {7, 5, 'H', 'E', 'L', 'L', 'O', 2},
+	}
+	expected := protocol.HelloMessage{1, protocol.CsvCode, protocol.NoCompression}
+
+	for _, code := range codecCodes {
+		codec, err := protocol.LookupCodec(code)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		reader := protocol.NewReader(bytes.NewReader(frames[code]))
+		reader.SetCodec(codec)
+		message, err := protocol.ReceiveAny(reader)
+		if err != nil {
+			t.Fatalf("%v: %v", code, err)
+		}
+		if message != expected {
+			t.Fatalf("%v: expected %#v, but got %#v", code, expected, message)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// A compression wraps the connection stream, below the buffered
+// reader/writer. Like the codec, it is chosen by the client in the
+// handshake, and applies to every message after it.
+
+type CompressionCode string
+
+const (
+	NoCompression    CompressionCode = "NONE"
+	FlateCompression CompressionCode = "FLATE"
+)
+
+type Compression interface {
+	Code() CompressionCode
+	// Wraps a writer, the returned writer must be flushed after each message
+	newWriter(w io.Writer) flushWriter
+	// Wraps a reader. Must not read from `r` until the returned reader is read.
+	newReader(r io.Reader) io.Reader
+}
+
+var compressions = map[CompressionCode]Compression{
+	NoCompression:    noCompression{},
+	FlateCompression: flateCompression{},
+}
+
+// Returns the compression identified by the given code
+func LookupCompression(code CompressionCode) (Compression, error) {
+	compression, ok := compressions[code]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", code)
+	}
+	return compression, nil
+}
+
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+type noCompression struct{}
+
+func (noCompression) Code() CompressionCode {
+	return NoCompression
+}
+
+func (noCompression) newWriter(w io.Writer) flushWriter {
+	return nopFlusher{w}
+}
+
+func (noCompression) newReader(r io.Reader) io.Reader {
+	return r
+}
+
+type nopFlusher struct {
+	io.Writer
+}
+
+func (nopFlusher) Flush() error {
+	return nil
+}
+
+// Compresses the stream with DEFLATE. Each flush emits a sync block, so
+// that every message can be decompressed as soon as it is received.
+type flateCompression struct{}
+
+func (flateCompression) Code() CompressionCode {
+	return FlateCompression
+}
+
+func (flateCompression) newWriter(w io.Writer) flushWriter {
+	// only fails with an invalid compression level
+	writer, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return writer
+}
+
+func (flateCompression) newReader(r io.Reader) io.Reader {
+	return flate.NewReader(r)
+}
+
+// Counts the bytes written to the inner writer
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// Flushes the inner writer, if it supports it
+func (c *countingWriter) Flush() error {
+	if flusher, ok := c.w.(flushWriter); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Counts the bytes read from the inner reader
+type countingReader struct {
+	r     io.Reader
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,69 @@
+package protocol_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+func TestCompression(t *testing.T) {
+	compression, err := protocol.LookupCompression(protocol.FlateCompression)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	bet := protocol.BetMessage{
+		"Laura",
+		"Lopez",
+		44160273,
+		time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		83,
+	}
+
+	var buf bytes.Buffer
+	writer := protocol.NewWriter(&buf)
+	reader := protocol.NewReader(&buf)
+
+	// the handshake is not compressed
+	_ = protocol.SendFlush(protocol.OkMessage{}, writer)
+	_ = writer.SetCompression(compression)
+
+	// sent in batches, each flush must be decompressable on its own
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			protocol.Send(bet, writer)
+		}
+		err = protocol.Flush(writer)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	_, err = protocol.Receive[protocol.OkMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// compressed data was already buffered, must not be lost
+	reader.SetCompression(compression)
+	for i := 0; i < 100; i++ {
+		received, err := protocol.Receive[protocol.BetMessage](reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !reflect.DeepEqual(received, bet) {
+			t.Fatalf("expected %v, but got %v", bet, received)
+		}
+	}
+
+	sent, sentWire := writer.Written()
+	received, receivedWire := reader.Received()
+	if sent != received || sentWire != receivedWire {
+		t.Fatalf("sent %v (%v), but received %v (%v)", sent, sentWire, received, receivedWire)
+	}
+	if sentWire >= sent {
+		t.Fatalf("expected compression, but sent %v bytes as %v", sent, sentWire)
+	}
+}
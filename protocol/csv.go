@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+)
+
+// Encodes each message as a single CSV record, where the first field is
+// the message code and the rest are the positional fields of the message.
+//
+//	BET,Laura,Lopez,44160273,2002-05-16,83
+type csvCodec struct{}
+
+func (csvCodec) Code() CodecCode {
+	return CsvCode
+}
+
+func (csvCodec) encode(m Message, w *safeio.Writer) {
+	rawData := Serialize(m)
+	data := append([]string{string(m.Code())}, rawData...)
+
+	w.Write(data)
+}
+
+func (csvCodec) decode(r *safeio.Reader) (Message, error) {
+	record, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	ty, err := lookup(MessageCode(record[0]), record)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := deserialize(ty, record[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return value.Interface().(Message), nil
+}
@@ -11,8 +11,18 @@ import (
 // Deserializes any value from a CSV record (list of strings)
 // It uses reflect package to access the desired value type in runtime
 func Deserialize[M any](record []string) (M, error) {
-	ty := reflect.TypeFor[M]()
 	var m M
+
+	value, err := deserialize(reflect.TypeFor[M](), record)
+	if value.IsValid() {
+		m = value.Interface().(M)
+	}
+
+	return m, err
+}
+
+// Like `Deserialize`, but the type is given in runtime
+func deserialize(ty reflect.Type, record []string) (reflect.Value, error) {
 	var value reflect.Value
 	var err error
 
@@ -25,8 +35,7 @@ func Deserialize[M any](record []string) (M, error) {
 		log.Panicf("unimplemented: deserialization of type %v", ty.Kind())
 	}
 
-	m = value.Interface().(M)
-	return m, err
+	return value, err
 }
 
 // Deserializes record into a struct
@@ -41,7 +50,11 @@ func deserializeStruct(ty reflect.Type, record []string, cursor int) (reflect.Va
 
 		var fieldValue reflect.Value
 		var err error
-		fieldValue, cursor, err = deserializePrimitive(fieldTy.Type, record, cursor)
+		if cursor >= len(record) && optional(fieldTy) {
+			fieldValue = defaultValue(fieldTy)
+		} else {
+			fieldValue, cursor, err = deserializePrimitive(fieldTy.Type, record, cursor)
+		}
 		if err != nil {
 			return value, cursor, err
 		}
@@ -57,15 +70,19 @@ func deserializeStruct(ty reflect.Type, record []string, cursor int) (reflect.Va
 func deserializeSlice(ty reflect.Type, record []string, cursor int) (reflect.Value, int, error) {
 	var value reflect.Value
 
-	len, cursor, err := deserializeInt(record, cursor)
+	length, cursor, err := deserializeInt(record, cursor)
 	if err != nil {
 		return value, cursor, err
 	}
+	// each element takes a field, so the length is bounded by the record
+	if length < 0 || length > len(record)-cursor {
+		return value, cursor, fmt.Errorf("field %v should be a valid length", cursor-1)
+	}
 
-	value = reflect.MakeSlice(ty, len, len)
+	value = reflect.MakeSlice(ty, length, length)
 	elemTy := ty.Elem()
 
-	for elemIdx := 0; elemIdx < len; elemIdx++ {
+	for elemIdx := 0; elemIdx < length; elemIdx++ {
 		elem := value.Index(elemIdx)
 
 		var elemValue reflect.Value
@@ -85,8 +102,21 @@ func deserializePrimitive(ty reflect.Type, record []string, cursor int) (reflect
 	pValue := reflect.New(ty)
 	value := pValue.Elem()
 
-	switch value.Interface().(type) {
-	case int:
+	if ty == reflect.TypeFor[time.Time]() {
+		valueToParse, err := advance(record, cursor)
+		if err != nil {
+			return value, cursor, err
+		}
+		valueToSet, err := time.Parse(time.DateOnly, valueToParse)
+		if err != nil {
+			return value, cursor, fmt.Errorf("field %v should be a date", cursor)
+		}
+		value.Set(reflect.ValueOf(valueToSet))
+		return value, cursor + 1, nil
+	}
+
+	switch ty.Kind() {
+	case reflect.Int:
 		var valueToSet int
 		var err error
 		valueToSet, cursor, err = deserializeInt(record, cursor)
@@ -94,25 +124,13 @@ func deserializePrimitive(ty reflect.Type, record []string, cursor int) (reflect
 			return value, cursor, err
 		}
 		value.SetInt(int64(valueToSet))
-	case string:
+	case reflect.String:
 		valueToSet, err := advance(record, cursor)
 		if err != nil {
 			return value, cursor, err
 		}
 		value.SetString(valueToSet)
 		cursor++
-	case time.Time:
-		valueToParse, err := advance(record, cursor)
-		if err != nil {
-			return value, cursor, err
-		}
-		valueToSet, err := time.Parse(time.DateOnly, valueToParse)
-		if err != nil {
-			return value, cursor, fmt.Errorf("field %v should be a date", cursor)
-		}
-		value = reflect.ValueOf(valueToSet)
-		cursor++
-
 	default:
 		log.Panicf("unimplemented: deserialization of type %v", ty)
 	}
@@ -120,6 +138,24 @@ func deserializePrimitive(ty reflect.Type, record []string, cursor int) (reflect
 	return value, cursor, nil
 }
 
+// Trailing fields added to an existing message must have a `default` tag,
+// so that the frames of agencies that predate them can still be decoded.
+// The default is given as its CSV representation.
+func optional(fieldTy reflect.StructField) bool {
+	_, ok := fieldTy.Tag.Lookup("default")
+	return ok
+}
+
+// Returns the default of an optional field
+// Panics if the default is invalid
+func defaultValue(fieldTy reflect.StructField) reflect.Value {
+	value, _, err := deserializePrimitive(fieldTy.Type, []string{fieldTy.Tag.Get("default")}, 0)
+	if err != nil {
+		log.Panicf("invalid default of field %v: %v", fieldTy.Name, err)
+	}
+	return value
+}
+
 func deserializeInt(record []string, cursor int) (int, int, error) {
 	var value int
 	valueToParse, err := advance(record, cursor)
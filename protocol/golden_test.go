@@ -0,0 +1,196 @@
+package protocol_test
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+// Golden files hold the exact bytes sent over the wire for each message,
+// with each codec. They are the reference for other implementations of
+// the protocol, so any change to them breaks compatibility with
+// deployed agencies. To regenerate them, run:
+//
+//	go test ./protocol -run Golden -update
+var update = flag.Bool("update", false, "regenerate golden files")
+
+const goldenDir = "testdata/golden"
+
+var goldenExtensions = map[protocol.CodecCode]string{
+	protocol.CsvCode:    "csv",
+	protocol.JsonCode:   "jsonl",
+	protocol.BinaryCode: "bin",
+}
+
+var goldenCases = []struct {
+	name    string
+	message protocol.Message
+}{
+	{"hello", protocol.HelloMessage{1, protocol.BinaryCode, protocol.FlateCompression}},
+	{"batch", protocol.BatchMessage{140, 1}},
+	{"bet", protocol.BetMessage{
+		"Laura",
+		"Lopez",
+		44160273,
+		time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		7574,
+	}},
+	{"bet_unicode", protocol.BetMessage{
+		"José María",
+		"Muñoz Ñandú",
+		30904465,
+		time.Date(1999, time.March, 17, 0, 0, 0, 0, time.UTC),
+		1,
+	}},
+	{"bet_max_values", protocol.BetMessage{
+		"",
+		"",
+		math.MaxInt64,
+		time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC),
+		math.MaxInt64,
+	}},
+	{"bet_min_values", protocol.BetMessage{
+		"",
+		"",
+		math.MinInt64,
+		time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC),
+		math.MinInt64,
+	}},
+	{"ok", protocol.OkMessage{}},
+	{"err", protocol.ErrMessage{protocol.StorageReason, 0}},
+	{"err_retry", protocol.ErrMessage{protocol.RateLimitedReason, 1500}},
+	// receipt of the `bet` case for agency 1, in the run of the challenge
+	// nonce, signed with the key of seed zero
+	{"ack", protocol.AckMessage{
+		1,
+		"000102030405060708090a0b0c0d0e0f",
+		1,
+		"545c8422908fde871be4a6811f1610cba985ceab48fd167407d55bada5c932f7",
+		"68cec181d8bf9d5ef82df2bc9a1306f84ad4f9f3941909394cb091525d5513442c57161b8f4a112c893904b69f938c3b78344f82823f22729776b1aaebb35d07",
+	}},
+	{"nack", protocol.NackMessage{2, protocol.RateLimitedReason, 1500}},
+	{"rejected", protocol.RejectedMessage{2, 7, protocol.DuplicateReason}},
+	{"finish", protocol.FinishMessage{}},
+	{"winners", protocol.WinnersMessage{30904465, 44160273}},
+	{"chain_head", protocol.ChainHeadMessage{"545c8422908fde871be4a6811f1610cba985ceab48fd167407d55bada5c932f7"}},
+	{"winners_empty", protocol.WinnersMessage{}},
+	{"winners_extremes", protocol.WinnersMessage{math.MinInt64, -1, 0, math.MaxInt64}},
+	{"agency_batch", protocol.AgencyBatchMessage{3, 1, 140}},
+	{"agency_finish", protocol.AgencyFinishMessage{3}},
+	{"agency_winners", protocol.AgencyWinnersMessage{3}},
+	{"subscribe", protocol.SubscribeMessage{}},
+	{"event", protocol.EventMessage{protocol.DrawCompletedEvent}},
+	{"ping", protocol.PingMessage{}},
+	{"pong", protocol.PongMessage{}},
+	{"challenge", protocol.ChallengeMessage{"000102030405060708090a0b0c0d0e0f"}},
+	// AuthMac of the challenge nonce, for agency 1 with secret `secreto`
+	{"auth", protocol.AuthMessage{"568c18600157a9b79000891d1f517dbee833acac44e999e2a27894c809cb6040"}},
+}
+
+func TestGolden(t *testing.T) {
+	for code, extension := range goldenExtensions {
+		codec, err := protocol.LookupCodec(code)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		for _, goldenCase := range goldenCases {
+			name := fmt.Sprintf("%v.%v", goldenCase.name, extension)
+			path := filepath.Join(goldenDir, name)
+
+			t.Run(name, func(t *testing.T) {
+				var buf bytes.Buffer
+				writer := protocol.NewWriter(&buf)
+				writer.SetCodec(codec)
+				_ = protocol.SendFlush(goldenCase.message, writer)
+
+				if *update {
+					err := os.WriteFile(path, buf.Bytes(), 0644)
+					if err != nil {
+						t.Fatalf("%v", err)
+					}
+				}
+
+				golden, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("%v", err)
+				}
+
+				if !bytes.Equal(buf.Bytes(), golden) {
+					t.Fatalf("serialization differs\nexpected: %q\ngot:      %q", golden, buf.Bytes())
+				}
+
+				reader := protocol.NewReader(bytes.NewReader(golden))
+				reader.SetCodec(codec)
+				message, err := protocol.ReceiveAny(reader)
+				if err != nil {
+					t.Fatalf("%v", err)
+				}
+				if !reflect.DeepEqual(message, goldenCase.message) {
+					t.Fatalf("deserialization differs\nexpected: %#v\ngot:      %#v", goldenCase.message, message)
+				}
+
+				_, err = protocol.ReceiveAny(reader)
+				if !errors.Is(err, io.EOF) {
+					t.Fatalf("expected a single message, but got %v", err)
+				}
+			})
+		}
+	}
+}
+
+// Frames sent by agencies that predate optional fields, which must still
+// be decoded. They are never regenerated, as no agency sends them anymore.
+var legacyGoldenCases = []struct {
+	name    string
+	message protocol.Message
+}{
+	{"legacy_hello", protocol.HelloMessage{1, protocol.CsvCode, protocol.NoCompression}},
+	{"legacy_batch", protocol.BatchMessage{140, 0}},
+}
+
+func TestGoldenLegacy(t *testing.T) {
+	for _, goldenCase := range legacyGoldenCases {
+		name := fmt.Sprintf("%v.%v", goldenCase.name, goldenExtensions[protocol.CsvCode])
+
+		t.Run(name, func(t *testing.T) {
+			golden, err := os.ReadFile(filepath.Join(goldenDir, name))
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			reader := protocol.NewReader(bytes.NewReader(golden))
+			message, err := protocol.ReceiveAny(reader)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !reflect.DeepEqual(message, goldenCase.message) {
+				t.Fatalf("deserialization differs\nexpected: %#v\ngot:      %#v", goldenCase.message, message)
+			}
+		})
+	}
+}
+
+// Every registered message must have at least one golden file
+func TestGoldenCoverage(t *testing.T) {
+	covered := make(map[protocol.MessageCode]bool)
+	for _, goldenCase := range goldenCases {
+		covered[goldenCase.message.Code()] = true
+	}
+
+	for _, code := range protocol.Codes() {
+		if !covered[code] {
+			t.Errorf("message %v has no golden file", code)
+		}
+	}
+}
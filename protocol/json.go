@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+)
+
+// Encodes each message as a single line JSON object. The `type` field
+// holds the message code, and the rest of the fields are named after the
+// fields of the message struct. Messages that are slices store their
+// elements in the `Items` field. Dates are formatted as `YYYY-MM-DD`.
+//
+//	{"type":"BET","FirstName":"Laura","LastName":"Lopez","Document":44160273,"Birthdate":"2002-05-16","Number":83}
+//
+// It is less compact than the CSV codec, but it can be easily read and
+// written by hand (or with tools like `jq`), so it is useful for
+// debugging and for third party integrations.
+type jsonCodec struct{}
+
+const jsonTypeField = "type"
+const jsonItemsField = "Items"
+
+func (jsonCodec) Code() CodecCode {
+	return JsonCode
+}
+
+func (jsonCodec) encode(m Message, w *safeio.Writer) {
+	var buf bytes.Buffer
+	value := reflect.ValueOf(m)
+
+	buf.WriteByte('{')
+	writeJsonField(&buf, jsonTypeField, string(m.Code()))
+
+	switch value.Kind() {
+	case reflect.Struct:
+		fields := reflect.VisibleFields(value.Type())
+		for _, fieldTy := range fields {
+			field := value.FieldByIndex(fieldTy.Index)
+			buf.WriteByte(',')
+			writeJsonField(&buf, fieldTy.Name, jsonPrimitive(field))
+		}
+	case reflect.Slice:
+		items := make([]any, 0, value.Len())
+		value.Seq2()(func(_, element reflect.Value) bool {
+			items = append(items, jsonPrimitive(element))
+			return true
+		})
+		buf.WriteByte(',')
+		writeJsonField(&buf, jsonItemsField, items)
+	default:
+		log.Panicf("unimplemented: serialization of type %v", value.Kind())
+	}
+
+	buf.WriteByte('}')
+	w.WriteLine(buf.Bytes())
+}
+
+func (jsonCodec) decode(r *safeio.Reader) (Message, error) {
+	line, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]json.RawMessage
+	err = json.Unmarshal(line, &object)
+	if err != nil {
+		return nil, err
+	}
+
+	var code MessageCode
+	err = json.Unmarshal(object[jsonTypeField], &code)
+	if err != nil {
+		return nil, fmt.Errorf("field %v is missing", jsonTypeField)
+	}
+
+	ty, err := lookup(code, []string{string(line)})
+	if err != nil {
+		return nil, err
+	}
+
+	value := reflect.New(ty).Elem()
+
+	switch ty.Kind() {
+	case reflect.Struct:
+		fields := reflect.VisibleFields(ty)
+		for _, fieldTy := range fields {
+			if _, ok := object[fieldTy.Name]; !ok && optional(fieldTy) {
+				value.FieldByIndex(fieldTy.Index).Set(defaultValue(fieldTy))
+				continue
+			}
+			fieldValue, err := parseJsonPrimitive(fieldTy.Type, object, fieldTy.Name)
+			if err != nil {
+				return nil, err
+			}
+			value.FieldByIndex(fieldTy.Index).Set(fieldValue)
+		}
+	case reflect.Slice:
+		var items []json.RawMessage
+		err = json.Unmarshal(object[jsonItemsField], &items)
+		if err != nil {
+			return nil, fmt.Errorf("field %v should be a list", jsonItemsField)
+		}
+
+		value.Set(reflect.MakeSlice(ty, len(items), len(items)))
+		for i, item := range items {
+			elemValue, err := unmarshalJsonPrimitive(ty.Elem(), item)
+			if err != nil {
+				return nil, fmt.Errorf("field %v has an invalid item: %w", jsonItemsField, err)
+			}
+			value.Index(i).Set(elemValue)
+		}
+	default:
+		log.Panicf("unimplemented: deserialization of type %v", ty.Kind())
+	}
+
+	return value.Interface().(Message), nil
+}
+
+// Writes a `"name":value` pair to the buffer
+func writeJsonField(buf *bytes.Buffer, name string, value any) {
+	encodedName, _ := json.Marshal(name)
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		log.Panicf("failed to encode field %v: %v", name, err)
+	}
+
+	buf.Write(encodedName)
+	buf.WriteByte(':')
+	buf.Write(encodedValue)
+}
+
+// Converts a primitive value into its JSON representation
+func jsonPrimitive(value reflect.Value) any {
+	if date, ok := value.Interface().(time.Time); ok {
+		return date.Format(time.DateOnly)
+	}
+
+	switch value.Kind() {
+	case reflect.Int:
+		return value.Int()
+	case reflect.String:
+		return value.String()
+	default:
+		log.Panicf("unimplemented: serialization of type %v", value.Type())
+	}
+
+	return nil
+}
+
+// Parses the field `name` of the object into a primitive of type `ty`
+func parseJsonPrimitive(ty reflect.Type, object map[string]json.RawMessage, name string) (reflect.Value, error) {
+	raw, ok := object[name]
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("field %v is missing", name)
+	}
+
+	value, err := unmarshalJsonPrimitive(ty, raw)
+	if err != nil {
+		return value, fmt.Errorf("field %v %w", name, err)
+	}
+
+	return value, nil
+}
+
+func unmarshalJsonPrimitive(ty reflect.Type, raw json.RawMessage) (reflect.Value, error) {
+	value := reflect.New(ty).Elem()
+
+	if ty == reflect.TypeFor[time.Time]() {
+		var valueToParse string
+		err := json.Unmarshal(raw, &valueToParse)
+		if err != nil {
+			return value, fmt.Errorf("should be a date")
+		}
+		valueToSet, err := time.Parse(time.DateOnly, valueToParse)
+		if err != nil {
+			return value, fmt.Errorf("should be a date")
+		}
+		value.Set(reflect.ValueOf(valueToSet))
+		return value, nil
+	}
+
+	switch ty.Kind() {
+	case reflect.Int:
+		var valueToSet int
+		err := json.Unmarshal(raw, &valueToSet)
+		if err != nil {
+			return value, fmt.Errorf("should be an int")
+		}
+		value.SetInt(int64(valueToSet))
+	case reflect.String:
+		var valueToSet string
+		err := json.Unmarshal(raw, &valueToSet)
+		if err != nil {
+			return value, fmt.Errorf("should be a string")
+		}
+		value.SetString(valueToSet)
+	default:
+		log.Panicf("unimplemented: deserialization of type %v", ty)
+	}
+
+	return value, nil
+}
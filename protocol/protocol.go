@@ -2,8 +2,10 @@ package protocol
 
 import (
 	"fmt"
+	"io"
 	"time"
 
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
 )
 
@@ -16,7 +18,8 @@ import (
 // list of strings.  This is how generic serialization packages like
 // `encondig/json` work.  In theory it could serialize any type, but in
 // practice I only implemented the necessary features for my particular
-// protocol.
+// protocol. How that list is put on the wire depends on the codec of
+// the connection (see `Codec`).
 //
 // This approach was not necessary, manually implementing the
 // serialization methods would probably have been faster (and more
@@ -33,78 +36,193 @@ const (
 	ErrCode     MessageCode = "ERR"
 	FinishCode  MessageCode = "FINISH"
 	WinnersCode MessageCode = "WINNERS"
+	PingCode    MessageCode = "PING"
+	PongCode    MessageCode = "PONG"
+	AckCode     MessageCode = "ACK"
+	NackCode    MessageCode = "NACK"
+	// Multiplexed messages, see `AgencyBatchMessage`
+	AgencyBatchCode   MessageCode = "AGENCY_BATCH"
+	AgencyFinishCode  MessageCode = "AGENCY_FINISH"
+	AgencyWinnersCode MessageCode = "AGENCY_WINNERS"
+	SubscribeCode     MessageCode = "SUBSCRIBE"
+	EventCode         MessageCode = "EVENT"
+	ChallengeCode     MessageCode = "CHALLENGE"
+	AuthCode          MessageCode = "AUTH"
+	ChainHeadCode     MessageCode = "CHAIN_HEAD"
+	RejectedCode      MessageCode = "REJECTED"
 )
 
 type Message interface {
 	Code() MessageCode
 }
 
-// Serializes a message as a list of strings and writes it to the writter.
-// If the message contains a comma, the field will be surrounded by
-// double quotes.
-func Send(m Message, w *safeio.Writer) {
-	rawData := Serialize(m)
-	data := append([]string{string(m.Code())}, rawData...)
+// Writes messages to a buffered writer, encoded with the codec of the
+// connection. Until the handshake is done, the codec is always CSV and
+// there is no compression.
+type Writer struct {
+	buf   *safeio.Writer
+	codec Codec
+	plain *countingWriter
+	wire  *countingWriter
+}
+
+func NewWriter(w io.Writer) *Writer {
+	wire := &countingWriter{w: w}
+	plain := &countingWriter{w: wire}
+
+	return &Writer{
+		buf:   safeio.NewWriter(plain),
+		codec: csvCodec{},
+		plain: plain,
+		wire:  wire,
+	}
+}
+
+// Changes the codec used to encode the following messages
+func (w *Writer) SetCodec(codec Codec) {
+	w.codec = codec
+}
+
+// Changes the compression of the following messages.
+// Any buffered message is flushed beforehand.
+func (w *Writer) SetCompression(compression Compression) error {
+	err := w.buf.Flush()
+	if err != nil {
+		return err
+	}
+
+	w.plain = &countingWriter{
+		w:     compression.newWriter(w.wire),
+		count: w.plain.count,
+	}
+	w.buf = safeio.NewWriter(w.plain)
+
+	return nil
+}
+
+// Returns the amount of bytes written, before and after compression
+func (w *Writer) Written() (plain int64, wire int64) {
+	return w.plain.count, w.wire.count
+}
+
+// Reads messages from a buffered reader, decoded with the codec of the
+// connection. Until the handshake is done, the codec is always CSV and
+// there is no compression.
+type Reader struct {
+	buf   *safeio.Reader
+	codec Codec
+	plain *countingReader
+	wire  *countingReader
+}
+
+func NewReader(r io.Reader) *Reader {
+	wire := &countingReader{r: r}
+	plain := &countingReader{r: wire}
+
+	return &Reader{
+		buf:   safeio.NewReader(plain),
+		codec: csvCodec{},
+		plain: plain,
+		wire:  wire,
+	}
+}
+
+// Changes the codec used to decode the following messages
+func (r *Reader) SetCodec(codec Codec) {
+	r.codec = codec
+}
+
+// Changes the compression of the following messages.
+// Data that was already buffered is decompressed too.
+func (r *Reader) SetCompression(compression Compression) {
+	// buffered data will be counted again once decompressed
+	r.plain = &countingReader{
+		r:     compression.newReader(r.buf.Stream()),
+		count: r.plain.count - int64(r.buf.Buffered()),
+	}
+	r.buf = safeio.NewReader(r.plain)
+}
+
+// Returns the amount of bytes read, after and before decompression
+func (r *Reader) Received() (plain int64, wire int64) {
+	return r.plain.count, r.wire.count
+}
 
-	w.Write(data)
+// Encodes a message with the writer codec and buffers it.
+func Send(m Message, w *Writer) {
+	w.codec.encode(m, w.buf)
 }
 
 // Like `Send`, but flushes the buffer afterwards.
-func SendFlush(m Message, w *safeio.Writer) error {
+func SendFlush(m Message, w *Writer) error {
 	Send(m, w)
 	return Flush(w)
 }
 
 // Flushes the buffer and returns any errors encountered
-func Flush(w *safeio.Writer) error {
-	return w.Flush()
+func Flush(w *Writer) error {
+	return w.buf.Flush()
 }
 
-func ReceiveAny(r *safeio.Reader) (m Message, err error) {
-	record, err := r.Read()
-	if err != nil {
-		return
-	}
-
-	switch MessageCode(record[0]) {
-	case HelloCode:
-		return Deserialize[HelloMessage](record[1:])
-	case BatchCode:
-		return Deserialize[BatchMessage](record[1:])
-	case BetCode:
-		return Deserialize[BetMessage](record[1:])
-	case OkCode:
-		return Deserialize[OkMessage](record[1:])
-	case ErrCode:
-		return Deserialize[ErrMessage](record[1:])
-	case FinishCode:
-		return Deserialize[FinishMessage](record[1:])
-	default:
-		return m, fmt.Errorf("invalid MessageCode")
-	}
+// Receives a message of any registered type.
+// If the code is unknown, returns an `ErrUnknownMessage`.
+func ReceiveAny(r *Reader) (Message, error) {
+	return r.codec.decode(r.buf)
 }
 
-func Receive[M Message](r *safeio.Reader) (M, error) {
+// Receives a message of type `M`.
+// Fails if the received message is of a different type. If it is an
+// `ErrMessage`, it is returned as the error.
+func Receive[M Message](r *Reader) (M, error) {
 	var m M
 
-	record, err := r.Read()
+	message, err := ReceiveAny(r)
 	if err != nil {
 		return m, err
 	}
 
-	if record[0] != string(m.Code()) {
-		return m, fmt.Errorf("expected code %v, got %v", m.Code(), record[0])
+	m, ok := message.(M)
+	if errMessage, isErr := message.(ErrMessage); !ok && isErr {
+		return m, errMessage
+	}
+	if !ok {
+		return m, fmt.Errorf("expected code %v, got %v", m.Code(), message.Code())
 	}
 
-	return Deserialize[M](record[1:])
+	return m, nil
 }
 
+// First message of every connection, always encoded as CSV. The client
+// chooses the codec and compression for the rest of the connection, and
+// the server answers with `OkMessage` if it supports them, or
+// `ErrMessage` otherwise. Agencies that predate the negotiation omit
+// them, and keep using CSV without compression.
 type HelloMessage struct {
-	AgencyId int
+	AgencyId    int
+	Codec       CodecCode       `default:"CSV"`
+	Compression CompressionCode `default:"NONE"`
+}
+
+// Sent by the server after `HelloMessage` when agencies must
+// authenticate, before accepting the handshake. The client answers with
+// `AuthMessage`, proving that it knows the secret of the agency.
+type ChallengeMessage struct {
+	Nonce string
+}
+
+// Answer to `ChallengeMessage`, computed with `AuthMac`
+type AuthMessage struct {
+	Mac string
 }
 
+// Announces a batch of `BatchSize` bets, which follow as `BetMessage`.
+// The agency may send several batches without waiting for their answer,
+// so each one is answered with `AckMessage` or `NackMessage` carrying
+// the same sequence number. Agencies that predate the sequence numbers
+// omit it, and wait for the answer of each batch before sending the next.
 type BatchMessage struct {
 	BatchSize int
+	Seq       int `default:"0"`
 }
 
 type BetMessage struct {
@@ -115,14 +233,141 @@ type BetMessage struct {
 	Number    int
 }
 
+// Hides the personal data of the bettor when logged
+func (m BetMessage) Redact() any {
+	return fmt.Sprintf("{%v %v %v %v %v}", common.MASK, common.MASK, common.HashSensitive(m.Document), common.MASK, m.Number)
+}
+
 type OkMessage struct{}
 
-type ErrMessage struct{}
+type ErrorReason string
+
+const (
+	// The server can't accept more connections
+	BusyReason ErrorReason = "BUSY"
+	// The agency is sending bets faster than allowed
+	RateLimitedReason ErrorReason = "RATE_LIMITED"
+	// The handshake asked for an unsupported feature
+	UnsupportedReason ErrorReason = "UNSUPPORTED"
+	// The bets could not be stored
+	StorageReason ErrorReason = "STORAGE"
+	// The batch exceeds the byte budget or the maximum size of the server
+	TooLargeReason ErrorReason = "TOO_LARGE"
+	// The connection may not act on behalf of the agency
+	UnauthorizedReason ErrorReason = "UNAUTHORIZED"
+	// The bet was already stored, see `RejectedMessage`
+	DuplicateReason ErrorReason = "DUPLICATE"
+	// The bettor reached the maximum bets per draw, see `RejectedMessage`
+	BetLimitReason ErrorReason = "BET_LIMIT"
+)
+
+// Sent by the server when a request fails. If `RetryAfter` is positive,
+// the request may be retried after that many milliseconds.
+// It implements `error`, so it is returned as such when receiving a
+// message of another type.
+type ErrMessage struct {
+	Reason     ErrorReason
+	RetryAfter int
+}
+
+func (m ErrMessage) Error() string {
+	if m.RetryAfter > 0 {
+		return fmt.Sprintf("server error %v, retry after %vms", m.Reason, m.RetryAfter)
+	}
+	return fmt.Sprintf("server error %v", m.Reason)
+}
+
+// Sent by the server once the batch `Seq` is stored, with the fields of
+// its `Receipt`
+type AckMessage struct {
+	Seq       int
+	RunId     string
+	Count     int
+	Hash      string
+	Signature string
+}
+
+// Sent by the server before the `AckMessage` of the batch `Seq`, for each
+// of its bets that was not stored. `Index` is the position of the bet in
+// the batch, starting from zero. The rest of the bets were stored.
+type RejectedMessage struct {
+	Seq    int
+	Index  int
+	Reason ErrorReason
+}
+
+// Sent by the server when the batch `Seq` could not be stored. If
+// `RetryAfter` is positive, the batch may be sent again after that many
+// milliseconds.
+type NackMessage struct {
+	Seq        int
+	Reason     ErrorReason
+	RetryAfter int
+}
+
+func (m NackMessage) Error() string {
+	return ErrMessage{m.Reason, m.RetryAfter}.Error()
+}
 
 type FinishMessage struct{}
 
 type WinnersMessage []int
 
+// Sent by the server before the winners, with the hash of the last block
+// of the bet store at the draw. The bets of the draw can't be changed
+// afterwards without changing it.
+type ChainHeadMessage struct {
+	Head string
+}
+
+// A hub aggregates several agencies over a single connection. After
+// introducing itself with `HelloMessage` (with its own id), it tags each
+// batch with the agency it belongs to. The server only accepts agencies
+// that the hub is authorized for. Otherwise, it's the same as
+// `BatchMessage`.
+type AgencyBatchMessage struct {
+	AgencyId  int
+	Seq       int
+	BatchSize int
+}
+
+// Like `FinishMessage`, for one of the agencies of a hub. Once every
+// agency of the hub finished, the server sends the winners of each one.
+type AgencyFinishMessage struct {
+	AgencyId int
+}
+
+// Sent to a hub before the `WinnersMessage` of each of its agencies
+type AgencyWinnersMessage struct {
+	AgencyId int
+}
+
+// Asks the server to push `EventMessage` to the agency, as they happen.
+// Events may arrive at any time after subscribing, between the answers
+// to the agency requests.
+type SubscribeMessage struct{}
+
+type EventKind string
+
+const (
+	// Every agency but one has finished
+	ClosingSoonEvent EventKind = "CLOSING_SOON"
+	// Every agency has finished, and the winners are being computed
+	DrawStartedEvent EventKind = "DRAW_STARTED"
+	// The winners are ready to be sent
+	DrawCompletedEvent EventKind = "DRAW_COMPLETED"
+)
+
+type EventMessage struct {
+	Event EventKind
+}
+
+// Keepalive probe, can be sent by either peer while it is waiting for the
+// other one. It must be answered with `PongMessage` as soon as possible.
+type PingMessage struct{}
+
+type PongMessage struct{}
+
 func (m BatchMessage) Code() MessageCode {
 	return BatchCode
 }
@@ -143,6 +388,14 @@ func (m ErrMessage) Code() MessageCode {
 	return ErrCode
 }
 
+func (m AckMessage) Code() MessageCode {
+	return AckCode
+}
+
+func (m NackMessage) Code() MessageCode {
+	return NackCode
+}
+
 func (m FinishMessage) Code() MessageCode {
 	return FinishCode
 }
@@ -150,3 +403,47 @@ func (m FinishMessage) Code() MessageCode {
 func (m WinnersMessage) Code() MessageCode {
 	return WinnersCode
 }
+
+func (m AgencyBatchMessage) Code() MessageCode {
+	return AgencyBatchCode
+}
+
+func (m AgencyFinishMessage) Code() MessageCode {
+	return AgencyFinishCode
+}
+
+func (m AgencyWinnersMessage) Code() MessageCode {
+	return AgencyWinnersCode
+}
+
+func (m SubscribeMessage) Code() MessageCode {
+	return SubscribeCode
+}
+
+func (m EventMessage) Code() MessageCode {
+	return EventCode
+}
+
+func (m PingMessage) Code() MessageCode {
+	return PingCode
+}
+
+func (m PongMessage) Code() MessageCode {
+	return PongCode
+}
+
+func (m ChallengeMessage) Code() MessageCode {
+	return ChallengeCode
+}
+
+func (m AuthMessage) Code() MessageCode {
+	return AuthCode
+}
+
+func (m ChainHeadMessage) Code() MessageCode {
+	return ChainHeadCode
+}
+
+func (m RejectedMessage) Code() MessageCode {
+	return RejectedCode
+}
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+)
+
+// Proof that the server stored a batch of bets of an agency. The server
+// sends it as `AckMessage`, signed with its receipts key, so that the
+// agency can later prove what the server accepted.
+type Receipt struct {
+	// identifies the run of the server, as `Seq` restarts on every run
+	RunId    string
+	AgencyId int
+	Seq      int
+	Count    int
+	// see `HashBets`
+	Hash string
+	// Ed25519 signature of the other fields, hex encoded
+	Signature string
+}
+
+// Hashes the bets of a batch with SHA-256, hex encoded. The bets are
+// hashed in their canonical form: the bytes that the CSV codec sends for
+// them, regardless of the codec of the connection.
+func HashBets(bets []BetMessage) string {
+	hash := sha256.New()
+	w := safeio.NewWriter(hash)
+	for _, bet := range bets {
+		csvCodec{}.encode(bet, w)
+	}
+	// writing to a hash never fails
+	_ = w.Flush()
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// The signed content of the receipt: every field but the signature
+func (r Receipt) payload() []byte {
+	return []byte(fmt.Sprintf("RECEIPT,%v,%v,%v,%v,%v", r.RunId, r.AgencyId, r.Seq, r.Count, r.Hash))
+}
+
+// Returns the receipt signed with the private key
+func (r Receipt) Sign(key ed25519.PrivateKey) Receipt {
+	r.Signature = hex.EncodeToString(ed25519.Sign(key, r.payload()))
+	return r
+}
+
+// Checks that the receipt was signed by the owner of the public key
+func (r Receipt) Verify(key ed25519.PublicKey) bool {
+	signature, err := hex.DecodeString(r.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, r.payload(), signature)
+}
@@ -0,0 +1,62 @@
+package protocol_test
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+func TestReceipt(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	bets := []protocol.BetMessage{{
+		"Laura",
+		"Lopez",
+		44160273,
+		time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		7574,
+	}}
+
+	receipt := protocol.Receipt{
+		RunId:    "000102030405060708090a0b0c0d0e0f",
+		AgencyId: 1,
+		Seq:      1,
+		Count:    len(bets),
+		Hash:     protocol.HashBets(bets),
+	}.Sign(key)
+
+	// same as the ack golden vector
+	expectedHash := "545c8422908fde871be4a6811f1610cba985ceab48fd167407d55bada5c932f7"
+	if receipt.Hash != expectedHash {
+		t.Fatalf("expected hash %v, got %v", expectedHash, receipt.Hash)
+	}
+	expectedSignature := "68cec181d8bf9d5ef82df2bc9a1306f84ad4f9f3941909394cb091525d5513442c57161b8f4a112c893904b69f938c3b78344f82823f22729776b1aaebb35d07"
+	if receipt.Signature != expectedSignature {
+		t.Fatalf("expected signature %v, got %v", expectedSignature, receipt.Signature)
+	}
+
+	public := key.Public().(ed25519.PublicKey)
+	if !receipt.Verify(public) {
+		t.Fatalf("valid receipt was rejected")
+	}
+
+	tampered := []protocol.Receipt{receipt, receipt, receipt, receipt, receipt, receipt}
+	tampered[0].AgencyId = 2
+	tampered[1].Seq = 2
+	tampered[2].Count = 2
+	tampered[3].Hash = protocol.HashBets(nil)
+	tampered[4].Signature = "not hex"
+	// the same batch of another run
+	tampered[5].RunId = "0f0e0d0c0b0a09080706050403020100"
+	for _, r := range tampered {
+		if r.Verify(public) {
+			t.Errorf("tampered receipt was accepted: %v", r)
+		}
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if receipt.Verify(other) {
+		t.Fatalf("receipt was accepted with another key")
+	}
+}
@@ -2,6 +2,7 @@ package protocol_test
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,8 +11,8 @@ import (
 
 func TestReflect(t *testing.T) {
 	messages := []any{
-		protocol.HelloMessage{83},
-		protocol.BatchMessage{83},
+		protocol.HelloMessage{83, protocol.JsonCode, protocol.FlateCompression},
+		protocol.BatchMessage{83, 3},
 		protocol.BetMessage{
 			"Laura",
 			"Lopez",
@@ -52,3 +53,23 @@ func TestReflect(t *testing.T) {
 		}
 	}
 }
+
+func TestDeserializeInvalidLength(t *testing.T) {
+	for _, record := range [][]string{
+		{"-1"},
+		{"3", "1", "2"},
+		{"9223372036854775807"},
+	} {
+		_, err := protocol.Deserialize[protocol.WinnersMessage](record)
+		if err == nil {
+			t.Fatalf("expected %v to be invalid", record)
+		}
+	}
+
+	// a malformed frame is an error, even before the handshake
+	reader := protocol.NewReader(strings.NewReader("WINNERS,-1\n"))
+	_, err := protocol.ReceiveAny(reader)
+	if err == nil {
+		t.Fatalf("expected a negative length to be invalid")
+	}
+}
@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+)
+
+// The registry maps each message code to the type of its message.
+// Every message type registers itself once, in the `init` function of
+// this module, and codecs dispatch through it when decoding. This way,
+// adding a new message only requires defining it and registering it.
+
+var registry = make(map[MessageCode]reflect.Type)
+
+// Registers the message type `M` under its code.
+// Panics if the code was already registered.
+func Register[M Message]() {
+	var m M
+	code := m.Code()
+
+	if _, ok := registry[code]; ok {
+		log.Panicf("message code %v already registered", code)
+	}
+
+	registry[code] = reflect.TypeFor[M]()
+}
+
+// Returns the codes of all registered messages, sorted
+func Codes() []MessageCode {
+	codes := make([]MessageCode, 0, len(registry))
+	for code := range registry {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+
+	return codes
+}
+
+// Returns the registered type for the given code, or an
+// `ErrUnknownMessage` carrying the raw record if there is none.
+func lookup(code MessageCode, record []string) (reflect.Type, error) {
+	ty, ok := registry[code]
+	if !ok {
+		return nil, ErrUnknownMessage{code, record}
+	}
+	return ty, nil
+}
+
+// Returned when receiving a message whose code has not been registered.
+// It carries the raw record, so that it can be skipped. The record may
+// hold personal data (with the JSON codec, it is the whole line), so it
+// must not be logged as is.
+type ErrUnknownMessage struct {
+	Code   MessageCode
+	Record []string
+}
+
+func (e ErrUnknownMessage) Error() string {
+	return fmt.Sprintf("unknown message code %q", e.Code)
+}
+
+func init() {
+	Register[HelloMessage]()
+	Register[BatchMessage]()
+	Register[BetMessage]()
+	Register[OkMessage]()
+	Register[ErrMessage]()
+	Register[AckMessage]()
+	Register[NackMessage]()
+	Register[FinishMessage]()
+	Register[WinnersMessage]()
+	Register[AgencyBatchMessage]()
+	Register[AgencyFinishMessage]()
+	Register[AgencyWinnersMessage]()
+	Register[SubscribeMessage]()
+	Register[EventMessage]()
+	Register[PingMessage]()
+	Register[PongMessage]()
+	Register[ChallengeMessage]()
+	Register[AuthMessage]()
+	Register[ChainHeadMessage]()
+	Register[RejectedMessage]()
+}
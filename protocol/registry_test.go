@@ -0,0 +1,49 @@
+package protocol_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+func TestRegistry(t *testing.T) {
+	codes := protocol.Codes()
+	if !slices.Contains(codes, protocol.WinnersCode) {
+		t.Fatalf("expected %v to be registered, got %v", protocol.WinnersCode, codes)
+	}
+
+	var buf bytes.Buffer
+	writer := protocol.NewWriter(&buf)
+	protocol.Send(protocol.WinnersMessage{1, 2, 3}, writer)
+	_ = protocol.Flush(writer)
+	buf.WriteString("UNKNOWN,1\n")
+	_ = protocol.SendFlush(protocol.OkMessage{}, writer)
+
+	reader := protocol.NewReader(&buf)
+
+	message, err := protocol.ReceiveAny(reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(message, protocol.WinnersMessage{1, 2, 3}) {
+		t.Fatalf("expected winners, but got %#v", message)
+	}
+
+	_, err = protocol.ReceiveAny(reader)
+	var unknownErr protocol.ErrUnknownMessage
+	if !errors.As(err, &unknownErr) {
+		t.Fatalf("expected ErrUnknownMessage, but got %v", err)
+	}
+	if !reflect.DeepEqual(unknownErr.Record, []string{"UNKNOWN", "1"}) {
+		t.Fatalf("unexpected record %v", unknownErr.Record)
+	}
+
+	_, err = protocol.Receive[protocol.OkMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -55,13 +55,15 @@ func serializeSlice(value reflect.Value) []string {
 
 // Serializes a primitive value into a CSV record
 func serializePrimitive(value reflect.Value) []string {
-	switch concreteValue := value.Interface().(type) {
-	case int:
-		return []string{strconv.Itoa(concreteValue)}
-	case string:
-		return []string{concreteValue}
-	case time.Time:
-		return []string{concreteValue.Format(time.DateOnly)}
+	if date, ok := value.Interface().(time.Time); ok {
+		return []string{date.Format(time.DateOnly)}
+	}
+
+	switch value.Kind() {
+	case reflect.Int:
+		return []string{strconv.Itoa(int(value.Int()))}
+	case reflect.String:
+		return []string{value.String()}
 	default:
 		log.Panicf("unimplemented: serialization of type %v", value.Type())
 	}
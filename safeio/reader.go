@@ -16,18 +16,55 @@ func NewReader(r io.Reader) *Reader {
 	}
 }
 
+// Reads a line and splits it into a CSV record
 func (r *Reader) Read() ([]string, error) {
-	rawRecord, err := r.buf.ReadBytes('\n')
+	rawRecord, err := r.ReadLine()
 	if err != nil {
 		return nil, err
 	}
-	rawRecord = rawRecord[:len(rawRecord)-1]
+
+	records := strings.Split(string(rawRecord), ",")
+	return records, nil
+}
+
+// Reads a full line, without the trailing line break
+func (r *Reader) ReadLine() ([]byte, error) {
+	line, err := r.buf.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
 
 	// drop carriage return if exists
-	if rawRecord[len(rawRecord)-1] == '\r' {
-		rawRecord = rawRecord[:len(rawRecord)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
 	}
 
-	records := strings.Split(string(rawRecord), ",")
-	return records, nil
+	return line, nil
+}
+
+// Reads a single byte
+func (r *Reader) ReadByte() (byte, error) {
+	return r.buf.ReadByte()
+}
+
+// Reads exactly `n` bytes
+func (r *Reader) ReadFull(n int) ([]byte, error) {
+	data := make([]byte, n)
+	_, err := io.ReadFull(r.buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Returns the underlying buffered stream. Reading from it consumes the
+// buffered data first, so it can be wrapped without losing any data.
+func (r *Reader) Stream() io.Reader {
+	return r.buf
+}
+
+// Returns the amount of bytes that have been buffered, but not yet read
+func (r *Reader) Buffered() int {
+	return r.buf.Buffered()
 }
@@ -21,10 +21,21 @@ func NewWriter(w io.Writer) *Writer {
 	}
 }
 
+// Writes a CSV record as a single line
 func (w *Writer) Write(record []string) {
 	message := strings.Join(record, ",")
 
-	w.write([]byte(message))
+	w.WriteLine([]byte(message))
+}
+
+// Writes raw `data`, without any delimiter
+func (w *Writer) WriteBytes(data []byte) {
+	w.write(data)
+}
+
+// Writes `data` followed by a line break
+func (w *Writer) WriteLine(data []byte) {
+	w.write(data)
 	w.write([]byte{'\n'})
 }
 
@@ -45,7 +56,7 @@ func (w *Writer) write(data []byte) {
 	}
 }
 
-// Writes all buffered data to inner writter
+// Writes all buffered data to inner writter, and flushes it if possible
 func (w *Writer) Flush() error {
 	if w.err != nil {
 		return w.err
@@ -66,7 +77,12 @@ func (w *Writer) Flush() error {
 		}
 	}
 
-	return nil
+	// flush inner writer, if it is also buffered
+	if flusher, ok := w.w.(interface{ Flush() error }); ok {
+		w.err = flusher.Flush()
+	}
+
+	return w.err
 }
 
 // Discards `number` front bytes from buffer
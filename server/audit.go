@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+)
+
+// Append-only record of noteworthy actions, as JSON lines. Unlike the
+// logs, each entry is synced to disk before the action is considered done.
+type auditLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+type auditEntry struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// agency the event belongs to, zero for server and admin events
+	AgencyId int            `json:"agency_id,omitempty"`
+	Fields   map[string]any `json:"fields,omitempty"`
+}
+
+// If the path is empty, returns a nil log that discards every entry
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+func newAuditEntry(event string, agencyId int, fields map[string]any) auditEntry {
+	return auditEntry{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		AgencyId: agencyId,
+		Fields:   fields,
+	}
+}
+
+// Appends an entry for the event, returning once it is durable.
+// Safe to call concurrently.
+func (a *auditLog) record(event string, agencyId int, fields map[string]any) error {
+	return a.recordAll([]auditEntry{newAuditEntry(event, agencyId, fields)})
+}
+
+// Appends the entries with a single write, returning once they are
+// durable. Safe to call concurrently.
+func (a *auditLog) recordAll(entries []auditEntry) error {
+	if a == nil || len(entries) == 0 {
+		return nil
+	}
+
+	var lines []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line...)
+		lines = append(lines, '\n')
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	_, err := a.file.Write(lines)
+	if err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// Records the event in the audit log of the server. Failing to record it
+// is logged, but does not interrupt the agencies.
+func (s *server) recordAudit(event string, agencyId int, fields map[string]any) {
+	err := s.config.audit.record(event, agencyId, fields)
+	if err != nil {
+		log.Error(common.FmtLog("audit", err,
+			"event", event,
+			"agency_id", agencyId,
+		))
+	}
+}
+
+// Identifies a batch given to the storage, for `auditCommit`
+type batchTag struct {
+	agencyId int
+	seq      int
+}
+
+// Records the batches of a storage commit, syncing the audit log once for
+// all of them. Called by the storage writer, after the commit is durable.
+func (s *server) auditCommit(batches []lottery.CommittedBatch) {
+	if s.config.audit == nil {
+		return
+	}
+
+	entries := make([]auditEntry, 0, len(batches))
+	for _, batch := range batches {
+		tag, ok := batch.Tag.(batchTag)
+		if !ok {
+			continue
+		}
+		entries = append(entries, newAuditEntry("commit_batch", tag.agencyId, map[string]any{
+			"seq":      tag.seq,
+			"count":    len(batch.Stored),
+			"hash":     protocol.HashBets(betMessages(batch.Stored)),
+			"rejected": len(batch.Rejected),
+		}))
+	}
+
+	err := s.config.audit.recordAll(entries)
+	if err != nil {
+		log.Error(common.FmtLog("audit", err,
+			"event", "commit_batch",
+			"batches", len(entries),
+		))
+	}
+}
+
+// Adds the error to the fields of an audit entry, if any
+func auditError(fields map[string]any, err error) map[string]any {
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	return fields
+}
+
+// Selects audit entries. Zero values match every entry.
+type auditFilter struct {
+	agencyId int
+	// inclusive
+	from time.Time
+	// exclusive
+	to time.Time
+}
+
+func (f auditFilter) matches(entry auditEntry) bool {
+	if f.agencyId != 0 && entry.AgencyId != f.agencyId {
+		return false
+	}
+	if !f.from.IsZero() && entry.Time.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && !entry.Time.Before(f.to) {
+		return false
+	}
+	return true
+}
+
+// Copies the entries of the audit log that match the filter, as they were
+// recorded. Returns the amount of entries copied.
+func queryAudit(r io.Reader, filter auditFilter, w io.Writer) (int, error) {
+	matched := 0
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var entry auditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return matched, fmt.Errorf("invalid entry at line %v: %w", line, err)
+		}
+		if !filter.matches(entry) {
+			continue
+		}
+
+		_, err = fmt.Fprintln(w, scanner.Text())
+		if err != nil {
+			return matched, err
+		}
+		matched++
+	}
+
+	return matched, scanner.Err()
+}
+
+// Parses a time of the audit query, either RFC 3339 or a date (in UTC)
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
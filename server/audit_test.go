@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := audit.record("commit_batch", i+1, map[string]any{"seq": i})
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	_ = audit.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer file.Close()
+
+	// every entry is a whole line, even if recorded concurrently
+	entries := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("invalid entry %q: %v", scanner.Text(), err)
+		}
+		if entry.Event != "commit_batch" || entry.AgencyId == 0 || entry.Time.IsZero() {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
+		entries++
+	}
+	if entries != 10 {
+		t.Fatalf("expected 10 entries, but got %v", entries)
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	audit, err := openAuditLog("")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = audit.record("erase", 0, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_ = audit.Close()
+}
+
+func TestQueryAudit(t *testing.T) {
+	recorded := strings.Join([]string{
+		`{"time":"2026-01-01T10:00:00Z","event":"handshake","agency_id":1}`,
+		`{"time":"2026-01-01T11:00:00Z","event":"handshake","agency_id":2}`,
+		`{"time":"2026-01-02T10:00:00Z","event":"finish","agency_id":1}`,
+		`{"time":"2026-01-03T10:00:00Z","event":"draw"}`,
+		``,
+	}, "\n")
+	lines := strings.Split(recorded, "\n")
+
+	from, _ := parseAuditTime("2026-01-01T11:00:00Z")
+	to, _ := parseAuditTime("2026-01-03")
+
+	cases := []struct {
+		filter   auditFilter
+		expected []string
+	}{
+		{auditFilter{}, lines[:4]},
+		{auditFilter{agencyId: 1}, []string{lines[0], lines[2]}},
+		{auditFilter{from: from}, lines[1:4]},
+		{auditFilter{from: from, to: to}, lines[1:3]},
+		{auditFilter{agencyId: 1, from: from, to: to}, lines[2:3]},
+	}
+	for _, c := range cases {
+		var out strings.Builder
+		matched, err := queryAudit(strings.NewReader(recorded), c.filter, &out)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expected := strings.Join(c.expected, "\n") + "\n"
+		if matched != len(c.expected) || out.String() != expected {
+			t.Fatalf("%+v: expected %q, but got %q", c.filter, expected, out.String())
+		}
+	}
+
+	_, err := queryAudit(strings.NewReader(recorded+"{\n"), auditFilter{}, io.Discard)
+	if err == nil {
+		t.Fatalf("expected an invalid entry to fail")
+	}
+}
+
+// Waits until the audit log has the entries, as some are recorded after
+// answering the agency
+func readAudit(t *testing.T, path string, count int) []auditEntry {
+	deadline := time.Now().Add(time.Second)
+	for {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		entries := make([]auditEntry, 0)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var entry auditEntry
+			err := json.Unmarshal([]byte(line), &entry)
+			if err != nil {
+				t.Fatalf("invalid entry %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) >= count || time.Now().After(deadline) {
+			return entries
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() {
+		_ = audit.Close()
+	})
+
+	s := newTestServer(t, serverConfig{
+		hubs:  map[int][]int{100: {1, 2, 3, 4, 5}},
+		audit: audit,
+	})
+	reader, writer := connectTestClient(t, s, 100)
+
+	bet := protocol.BetMessage{
+		FirstName: "Laura",
+		LastName:  "Lopez",
+		Document:  44160273,
+		Birthdate: time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		Number:    lottery.LOTTERY_WINNER_NUMBER,
+	}
+	protocol.Send(protocol.AgencyBatchMessage{AgencyId: 3, Seq: 7, BatchSize: 1}, writer)
+	_ = protocol.SendFlush(bet, writer)
+	ack, err := protocol.Receive[protocol.AckMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for agencyId := 1; agencyId <= 5; agencyId++ {
+		_ = protocol.SendFlush(protocol.AgencyFinishMessage{AgencyId: agencyId}, writer)
+	}
+	chainHead, err := protocol.Receive[protocol.ChainHeadMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// handshake, batch, 5 finish, draw and 5 deliveries
+	entries := readAudit(t, path, 13)
+	events := make(map[string]int)
+	for _, entry := range entries {
+		events[entry.Event]++
+
+		switch entry.Event {
+		case "handshake":
+			if entry.AgencyId != 100 || entry.Fields["hub"] != true {
+				t.Fatalf("unexpected handshake %+v", entry)
+			}
+		case "commit_batch":
+			if entry.AgencyId != 3 || entry.Fields["seq"] != 7.0 || entry.Fields["hash"] != ack.Hash {
+				t.Fatalf("unexpected batch %+v", entry)
+			}
+		case "draw":
+			if entry.Fields["winners"] != 1.0 || entry.Fields["chain_head"] != chainHead.Head {
+				t.Fatalf("unexpected draw %+v", entry)
+			}
+		case "deliver_winners":
+			winners := 0.0
+			if entry.AgencyId == 3 {
+				winners = 1
+			}
+			if entry.Fields["winners"] != winners || entry.Fields["error"] != nil {
+				t.Fatalf("unexpected delivery %+v", entry)
+			}
+		}
+	}
+
+	expected := map[string]int{"handshake": 1, "commit_batch": 1, "finish": 5, "draw": 1, "deliver_winners": 5}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected events %v, but got %v", expected, events)
+	}
+
+	// the personal data of the bettors is never recorded
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "44160273") || strings.Contains(string(data), "Lopez") {
+		t.Fatalf("audit log contains personal data: %s", data)
+	}
+}
+
+func TestRejectionAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() {
+		_ = audit.Close()
+	})
+
+	s := newTestServer(t, serverConfig{
+		audit:          audit,
+		busyRetryAfter: time.Second,
+	})
+
+	// sends the first message of a connection, and waits for it to end
+	connect := func(handle func(context.Context, net.Conn), first protocol.Message) {
+		conn, serverConn := net.Pipe()
+		defer conn.Close()
+		done := make(chan struct{})
+		go func() {
+			handle(context.Background(), serverConn)
+			close(done)
+		}()
+
+		_ = protocol.SendFlush(first, protocol.NewWriter(conn))
+		_, _ = protocol.ReceiveAny(protocol.NewReader(conn))
+		_ = conn.Close()
+		<-done
+	}
+	hello := func(agencyId int, codec protocol.CodecCode, compression protocol.CompressionCode) protocol.HelloMessage {
+		return protocol.HelloMessage{AgencyId: agencyId, Codec: codec, Compression: compression}
+	}
+
+	connect(s.handleClient, protocol.BatchMessage{BatchSize: 1})
+	connect(s.handleClient, hello(MAX_AGENCIES+1, protocol.CsvCode, protocol.NoCompression))
+	connect(s.handleClient, hello(1, "XML", protocol.NoCompression))
+	connect(s.handleClient, hello(1, protocol.CsvCode, "ZIP"))
+	connect(s.refuseClient, hello(1, protocol.CsvCode, protocol.NoCompression))
+
+	entries := readAudit(t, path, 5)
+	expected := []struct {
+		agencyId int
+		reason   string
+	}{
+		{0, "hello_failed"},
+		{MAX_AGENCIES + 1, "unknown_agency"},
+		{1, "unsupported_codec"},
+		{1, "unsupported_compression"},
+		{0, "busy"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %v entries, but got %+v", len(expected), entries)
+	}
+	for i, entry := range entries {
+		if entry.Event != "reject_connection" || entry.AgencyId != expected[i].agencyId || entry.Fields["reason"] != expected[i].reason {
+			t.Fatalf("expected a rejection of agency %v for %v, but got %+v", expected[i].agencyId, expected[i].reason, entry)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+// Returned when the client does not prove that it knows the secret of
+// the agency, or its source failed too many times already
+var errUnauthenticated = errors.New("authentication failed")
+
+// Parses the secret of each agency, with the format
+// `agency:secret,agency:secret...`. Secrets may not contain `,`, and
+// surrounding spaces are ignored. Empty entries are ignored.
+func parseSecrets(secrets string) (map[int][]byte, error) {
+	parsed := make(map[int][]byte)
+
+	for _, entry := range strings.Split(secrets, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		agency, secret, ok := strings.Cut(entry, ":")
+		if !ok {
+			// the entry is not logged, as it may be a secret
+			return nil, errors.New("invalid secret, expected `agency:secret`")
+		}
+
+		agencyId, err := strconv.Atoi(strings.TrimSpace(agency))
+		if err != nil {
+			return nil, fmt.Errorf("invalid agency %q: %w", agency, err)
+		}
+		if _, ok := parsed[agencyId]; ok {
+			return nil, fmt.Errorf("agency %v is configured twice", agencyId)
+		}
+
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			return nil, fmt.Errorf("agency %v has an empty secret", agencyId)
+		}
+		parsed[agencyId] = []byte(secret)
+	}
+
+	return parsed, nil
+}
+
+// Challenges the client to prove that it knows the secret of the agency,
+// if secrets are configured. Sources that fail too often are refused
+// before being challenged, until their failures are forgotten.
+func (s *server) authenticate(conn net.Conn, reader *protocol.Reader, writer *protocol.Writer, agencyId int) error {
+	if len(s.config.agencySecrets) == 0 {
+		return nil
+	}
+
+	source := remoteHost(conn)
+	ok, retryAfter := s.authLimiter.peek(source)
+	if !ok {
+		sendErr := protocol.SendFlush(protocol.ErrMessage{
+			Reason:     protocol.RateLimitedReason,
+			RetryAfter: int(retryAfter.Milliseconds()),
+		}, writer)
+		s.recordAuthentication(conn, agencyId, "rate_limited")
+		return errors.Join(fmt.Errorf("%w: too many failures from %v", errUnauthenticated, source), sendErr)
+	}
+
+	nonce, err := protocol.NewNonce()
+	if err != nil {
+		return err
+	}
+	err = protocol.SendFlush(protocol.ChallengeMessage{Nonce: nonce}, writer)
+	if err != nil {
+		return err
+	}
+
+	auth, err := protocol.Receive[protocol.AuthMessage](reader)
+	if err != nil {
+		return err
+	}
+
+	secret, ok := s.config.agencySecrets[agencyId]
+	if !ok || !protocol.VerifyAuthMac(secret, nonce, agencyId, auth.Mac) {
+		s.authLimiter.take(source, 1)
+		s.recordAuthentication(conn, agencyId, "failure")
+		sendErr := protocol.SendFlush(protocol.ErrMessage{Reason: protocol.UnauthorizedReason}, writer)
+		return errors.Join(fmt.Errorf("%w: invalid answer for agency %v", errUnauthenticated, agencyId), sendErr)
+	}
+
+	s.recordAuthentication(conn, agencyId, "success")
+	return nil
+}
+
+// Records the outcome of an authentication in the audit log
+func (s *server) recordAuthentication(conn net.Conn, agencyId int, result string) {
+	s.recordAudit("authenticate", agencyId, map[string]any{
+		"remote_address": conn.RemoteAddr().String(),
+		"result":         result,
+	})
+}
+
+// Identifies the source of a connection, without the port as it changes
+// on each connection
+func remoteHost(conn net.Conn) string {
+	address := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+func TestParseSecrets(t *testing.T) {
+	secrets, err := parseSecrets(" 1:secreto , 2: otro:secreto ,")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := map[int][]byte{1: []byte("secreto"), 2: []byte("otro:secreto")}
+	if !reflect.DeepEqual(secrets, expected) {
+		t.Fatalf("expected %v, but got %v", expected, secrets)
+	}
+
+	for _, invalid := range []string{"1", "1:", "agencia:secreto", "1:a,1:b"} {
+		_, err := parseSecrets(invalid)
+		if err == nil {
+			t.Fatalf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+// Starts a handshake with the server in memory, answering the challenge
+// with the given secret
+func authenticateTestClient(t *testing.T, s *server, agencyId int, secret []byte) error {
+	conn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go s.handleClient(context.Background(), serverConn)
+
+	reader := protocol.NewReader(conn)
+	writer := protocol.NewWriter(conn)
+
+	_ = protocol.SendFlush(protocol.HelloMessage{
+		AgencyId:    agencyId,
+		Codec:       protocol.CsvCode,
+		Compression: protocol.NoCompression,
+	}, writer)
+	challenge, err := protocol.Receive[protocol.ChallengeMessage](reader)
+	if err != nil {
+		return err
+	}
+
+	_ = protocol.SendFlush(protocol.AuthMessage{
+		Mac: protocol.AuthMac(secret, challenge.Nonce, agencyId),
+	}, writer)
+	_, err = protocol.Receive[protocol.OkMessage](reader)
+	return err
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newTestServer(t, serverConfig{
+		agencySecrets:    map[int][]byte{1: []byte("secreto"), 2: []byte("otro")},
+		authFailureRate:  0.001,
+		authFailureBurst: 2,
+	})
+
+	err := authenticateTestClient(t, s, 1, []byte("secreto"))
+	if err != nil {
+		t.Fatalf("expected a valid secret to be accepted, got %v", err)
+	}
+
+	// the secret of another agency is not valid
+	for i := 0; i < 2; i++ {
+		err = authenticateTestClient(t, s, 1, []byte("otro"))
+		var errMessage protocol.ErrMessage
+		if !errors.As(err, &errMessage) || errMessage.Reason != protocol.UnauthorizedReason {
+			t.Fatalf("expected %v, got %v", protocol.UnauthorizedReason, err)
+		}
+	}
+
+	// every connection in memory has the same source, which failed too
+	// many times, so it is refused before being challenged
+	err = authenticateTestClient(t, s, 2, []byte("otro"))
+	var errMessage protocol.ErrMessage
+	if !errors.As(err, &errMessage) || errMessage.Reason != protocol.RateLimitedReason {
+		t.Fatalf("expected %v, got %v", protocol.RateLimitedReason, err)
+	}
+	if errMessage.RetryAfter <= 0 {
+		t.Fatalf("expected a retry delay, got %v", errMessage.RetryAfter)
+	}
+
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Sets the backlog of a listening socket. A zero backlog keeps the
+// system default.
+//
+// The standard library always calls listen(2) with the system maximum
+// right after the control hook, so the backlog can't be set from it.
+// Instead, listen(2) is called again on the listening socket, which Linux
+// allows in order to update its backlog. Other systems don't guarantee
+// it, so they keep the default (see backlog_other.go).
+func setListenBacklog(listener net.Listener, backlog int) error {
+	if backlog == 0 {
+		return nil
+	}
+
+	// in-memory listeners have no socket
+	sysListener, ok := listener.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+
+	conn, err := sysListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	err = conn.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+)
+
+// The backlog can only be updated on Linux (see backlog_linux.go).
+// Elsewhere, the system default is kept.
+func setListenBacklog(_ net.Listener, backlog int) error {
+	if backlog != 0 {
+		log.Warning(common.FmtLog("listen_backlog", errors.New("unsupported on this system"),
+			"backlog", backlog,
+		))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+var errEventQueueFull = errors.New("event queue is full")
+
+// Amount of events that can be queued for a subscriber before they are
+// dropped
+const EVENT_QUEUE_SIZE = 8
+
+// Broadcasts server events to the subscribed connections. Each subscriber
+// has its own queue, so that a slow connection can't block the others.
+type events struct {
+	lock        sync.Mutex
+	subscribers map[chan protocol.EventKind]struct{}
+}
+
+func newEvents() *events {
+	return &events{
+		subscribers: make(map[chan protocol.EventKind]struct{}),
+	}
+}
+
+// Returns a queue that receives every event published from now on
+func (e *events) subscribe() chan protocol.EventKind {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	queue := make(chan protocol.EventKind, EVENT_QUEUE_SIZE)
+	e.subscribers[queue] = struct{}{}
+
+	return queue
+}
+
+// Stops publishing to the queue, and closes it
+func (e *events) unsubscribe(queue chan protocol.EventKind) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	delete(e.subscribers, queue)
+	close(queue)
+}
+
+// Queues the event for every subscriber, without waiting for them
+func (e *events) publish(event protocol.EventKind) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	log.Info(common.FmtLog("publish_event", nil,
+		"event", event,
+		"subscribers", len(e.subscribers),
+	))
+
+	for queue := range e.subscribers {
+		select {
+		case queue <- event:
+		default:
+			log.Warning(common.FmtLog("publish_event", errEventQueueFull,
+				"event", event,
+			))
+		}
+	}
+}
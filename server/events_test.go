@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+)
+
+func TestEvents(t *testing.T) {
+	s := newTestServer(t, serverConfig{
+		hubs: map[int][]int{100: {2, 3, 4, 5}},
+	})
+
+	reader, writer := connectTestClient(t, s, 1)
+	_ = protocol.SendFlush(protocol.SubscribeMessage{}, writer)
+	// once answered, the subscription was handled
+	_ = protocol.SendFlush(protocol.PingMessage{}, writer)
+	_, err := protocol.Receive[protocol.PongMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// every other agency finishes through the hub
+	hubReader, hubWriter := connectTestClient(t, s, 100)
+	for agencyId := 2; agencyId <= 5; agencyId++ {
+		_ = protocol.SendFlush(protocol.AgencyFinishMessage{AgencyId: agencyId}, hubWriter)
+	}
+	go func() {
+		for {
+			_, err := protocol.ReceiveAny(hubReader)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	event, err := protocol.Receive[protocol.EventMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if event.Event != protocol.ClosingSoonEvent {
+		t.Fatalf("expected %v, but got %v", protocol.ClosingSoonEvent, event.Event)
+	}
+
+	_ = protocol.SendFlush(protocol.FinishMessage{}, writer)
+
+	// the draw events are sent before the winners
+	for _, expected := range []protocol.EventKind{protocol.DrawStartedEvent, protocol.DrawCompletedEvent} {
+		event, err := protocol.Receive[protocol.EventMessage](reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if event.Event != expected {
+			t.Fatalf("expected %v, but got %v", expected, event.Event)
+		}
+	}
+
+	_, err = protocol.Receive[protocol.ChainHeadMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = protocol.Receive[protocol.WinnersMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -6,125 +6,435 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
-	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
 )
 
 type handler struct {
+	// id given in the handshake, of an agency or a hub
 	agencyId int
-	conn     net.Conn
-	reader   *safeio.Reader
-	writer   *safeio.Writer
-	server   *server
+	// a hub multiplexes several agencies over the connection
+	hub bool
+	// agencies the connection may send bets for, and whether they finished
+	agencies    map[int]bool
+	codec       protocol.Codec
+	compression protocol.Compression
+	conn        net.Conn
+	reader      *protocol.Reader
+	writer      *protocol.Writer
+	// serializes the answers with the events pushed to the agency
+	writeLock sync.Mutex
+	// events the agency subscribed to, nil if it did not
+	events     chan protocol.EventKind
+	eventsDone chan struct{}
+	sizer      *protocol.Sizer
+	server     *server
 }
 
 func createHandler(s *server, conn net.Conn) (*handler, error) {
-	reader := safeio.NewReader(conn)
+	reader := protocol.NewReader(conn)
+	writer := protocol.NewWriter(conn)
 
 	hello, err := protocol.Receive[protocol.HelloMessage](reader)
 	if err != nil {
+		s.recordRejection(conn, 0, "hello_failed", err)
 		return nil, err
 	}
 
+	err = verifyIdentity(conn, hello.AgencyId)
+	if err != nil {
+		s.recordAuthentication(conn, hello.AgencyId, "certificate_mismatch")
+		sendErr := protocol.SendFlush(protocol.ErrMessage{Reason: protocol.UnauthorizedReason}, writer)
+		return nil, errors.Join(err, sendErr)
+	}
+
+	// hubs act on behalf of their agencies, which are checked by `parseHubs`
+	hubAgencies, hub := s.config.hubs[hello.AgencyId]
+	if !hub && !validAgency(hello.AgencyId) {
+		err := fmt.Errorf("unknown agency %v", hello.AgencyId)
+		s.recordRejection(conn, hello.AgencyId, "unknown_agency", err)
+		sendErr := protocol.SendFlush(protocol.ErrMessage{Reason: protocol.UnauthorizedReason}, writer)
+		return nil, errors.Join(err, sendErr)
+	}
+
+	codec, err := protocol.LookupCodec(hello.Codec)
+	if err != nil {
+		s.recordRejection(conn, hello.AgencyId, "unsupported_codec", err)
+		sendErr := protocol.SendFlush(protocol.ErrMessage{Reason: protocol.UnsupportedReason}, writer)
+		return nil, errors.Join(err, sendErr)
+	}
+	compression, err := protocol.LookupCompression(hello.Compression)
+	if err != nil {
+		s.recordRejection(conn, hello.AgencyId, "unsupported_compression", err)
+		sendErr := protocol.SendFlush(protocol.ErrMessage{Reason: protocol.UnsupportedReason}, writer)
+		return nil, errors.Join(err, sendErr)
+	}
+
+	err = s.authenticate(conn, reader, writer, hello.AgencyId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = protocol.SendFlush(protocol.OkMessage{}, writer)
+	if err != nil {
+		return nil, err
+	}
+
+	reader.SetCodec(codec)
+	writer.SetCodec(codec)
+	reader.SetCompression(compression)
+	err = writer.SetCompression(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	agencies := map[int]bool{hello.AgencyId: false}
+	if hub {
+		agencies = make(map[int]bool)
+		for _, agencyId := range hubAgencies {
+			agencies[agencyId] = false
+		}
+	}
+
 	return &handler{
-		agencyId: hello.AgencyId,
-		conn:     conn,
-		reader:   reader,
-		writer:   safeio.NewWriter(conn),
-		server:   s,
+		agencyId:    hello.AgencyId,
+		hub:         hub,
+		agencies:    agencies,
+		codec:       codec,
+		compression: compression,
+		conn:        conn,
+		reader:      reader,
+		writer:      writer,
+		sizer:       protocol.NewSizer(codec),
+		server:      s,
 	}, nil
 }
 
-func (h *handler) run(ctx context.Context) (err error) {
-	closer := common.SpawnCloser(ctx, h.conn, closeConnection)
-	defer func() {
-		closeErr := closer.Close()
-		err = errors.Join(err, closeErr)
-	}()
+// Records a connection rejected during the handshake, other than by its
+// authentication (see `recordAuthentication`)
+func (s *server) recordRejection(conn net.Conn, agencyId int, reason string, err error) {
+	s.recordAudit("reject_connection", agencyId, auditError(map[string]any{
+		"remote_address": conn.RemoteAddr().String(),
+		"reason":         reason,
+	}, err))
+}
+
+// Prefix of the common name of agency certificates, followed by the id
+const AGENCY_CERT_PREFIX = "agency-"
+
+// Checks that the id claimed by the client matches its certificate, if
+// it presented one (mutual TLS)
+func verifyIdentity(conn net.Conn, agencyId int) error {
+	name, ok := transport.PeerName(conn)
+	if !ok {
+		return nil
+	}
+
+	if name != fmt.Sprintf("%v%v", AGENCY_CERT_PREFIX, agencyId) {
+		return fmt.Errorf("agency %v does not match certificate %q", agencyId, name)
+	}
+	return nil
+}
+
+func (h *handler) run(ctx context.Context) error {
+	defer h.logTraffic()
+	defer h.unsubscribe()
 
 	for {
-		var message protocol.Message
+		// the agency may take up to the idle timeout to send its next message
+		err := common.SetDeadline(h.conn.SetReadDeadline, h.server.config.idleTimeout)
+		if err != nil {
+			return err
+		}
+
 		message, err := protocol.ReceiveAny(h.reader)
+		var unknownErr protocol.ErrUnknownMessage
+		if errors.As(err, &unknownErr) {
+			log.Warning(common.FmtLog("receive_message", err,
+				"agency_id", h.agencyId,
+				// the record may hold personal data, the error has its code
+				"fields", len(unknownErr.Record),
+			))
+			continue
+		}
 		if err != nil {
 			return err
 		}
 
 		switch message := message.(type) {
 		case protocol.BatchMessage:
-			err = h.receiveBatch(message.BatchSize)
+			err = h.handleBatch(h.agencyId, message, h.sizer.Size(message))
+		case protocol.AgencyBatchMessage:
+			err = h.handleBatch(message.AgencyId, protocol.BatchMessage{
+				Seq:       message.Seq,
+				BatchSize: message.BatchSize,
+			}, h.sizer.Size(message))
+		case protocol.FinishMessage:
+			err = h.finish(ctx, h.agencyId)
+			if err != nil || h.allFinished() {
+				return err
+			}
+		case protocol.AgencyFinishMessage:
+			err = h.finish(ctx, message.AgencyId)
+			if err != nil || h.allFinished() {
+				return err
+			}
+		case protocol.SubscribeMessage:
+			h.subscribe()
+		case protocol.PingMessage:
+			err = h.send(protocol.PongMessage{})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Receives a batch for the agency. Failing to store it is not fatal, as
+// the agency is told so and may send the rest of the batches.
+func (h *handler) handleBatch(agencyId int, batch protocol.BatchMessage, headerSize int) error {
+	err := h.receiveBatch(agencyId, batch, headerSize)
+	if err != nil {
+		log.Error(common.FmtLog("receive_batch", err,
+			"agency_id", agencyId,
+			"seq", batch.Seq,
+		))
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, errInvalidBatchSize) {
+			return err
+		}
+		return nil
+	}
+
+	log.Info(common.FmtLog("receive_batch", nil,
+		"agency_id", agencyId,
+		"seq", batch.Seq,
+		"batch_size", batch.BatchSize,
+	))
+	return nil
+}
+
+// Marks the agency as finished. Once every agency of the connection
+// finished, waits for the draw and sends the winners.
+func (h *handler) finish(ctx context.Context, agencyId int) error {
+	finished, ok := h.agencies[agencyId]
+	if !ok {
+		log.Error(common.FmtLog("receive_finish", protocol.ErrMessage{Reason: protocol.UnauthorizedReason},
+			"agency_id", agencyId,
+		))
+		return h.send(protocol.ErrMessage{Reason: protocol.UnauthorizedReason})
+	}
+	if !finished {
+		h.agencies[agencyId] = true
+		h.server.finishAgency(agencyId)
+	}
+	h.server.recordAudit("finish", agencyId, map[string]any{
+		"repeated": finished,
+	})
+
+	log.Info(common.FmtLog("receive_finish", nil,
+		"agency_id", agencyId,
+	))
+
+	if !h.allFinished() {
+		return nil
+	}
+	return h.sendWinners(ctx)
+}
+
+// Returns true if every agency of the connection finished
+func (h *handler) allFinished() bool {
+	for _, finished := range h.agencies {
+		if !finished {
+			return false
+		}
+	}
+	return true
+}
+
+// Pushes server events to the agency, until the handler stops
+func (h *handler) subscribe() {
+	if h.events != nil {
+		return
+	}
+	h.events = h.server.events.subscribe()
+	h.eventsDone = make(chan struct{})
+
+	log.Info(common.FmtLog("subscribe", nil,
+		"agency_id", h.agencyId,
+	))
+
+	go func() {
+		defer close(h.eventsDone)
+		for event := range h.events {
+			err := h.send(protocol.EventMessage{Event: event})
 			if err != nil {
-				log.Error(common.FmtLog("receive_batch", err,
+				log.Error(common.FmtLog("send_event", err,
 					"agency_id", h.agencyId,
+					"event", event,
 				))
-				if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
-					return err
-				}
-			} else {
-				log.Info(common.FmtLog("receive_batch", nil,
-					"agency_id", h.agencyId,
-					"batch_size", message.BatchSize,
-				))
+				return
 			}
-		case protocol.FinishMessage:
-			h.server.lotteryFinish.Done()
+		}
+	}()
+}
 
-			log.Info(common.FmtLog("receive_finish", nil,
-				"agency_id", h.agencyId,
-			))
+// Stops pushing events to the agency, if it had subscribed. Events that
+// were already queued are sent before returning.
+func (h *handler) unsubscribe() {
+	if h.events == nil {
+		return
+	}
+	h.server.events.unsubscribe(h.events)
+	<-h.eventsDone
+	h.events = nil
+}
 
-			err := h.sendWinners(ctx)
+// Waits for the draw and sends the winners to the agency. While waiting,
+// the agency is probed periodically to detect if it is still alive.
+func (h *handler) sendWinners(ctx context.Context) error {
+	var keepalive <-chan time.Time
+	if h.server.config.keepalivePeriod > 0 {
+		ticker := time.NewTicker(h.server.config.keepalivePeriod)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return net.ErrClosed
+		case <-keepalive:
+			err := h.ping()
 			if err != nil {
 				return err
 			}
+		case <-h.server.drawDone:
+			if h.server.drawErr != nil {
+				return h.server.drawErr
+			}
+			winners := h.server.winners
+
+			// no more events after the winners
+			h.unsubscribe()
+
+			chainHead := protocol.ChainHeadMessage{Head: h.server.chainHead}
+			var err error
+			if !h.hub {
+				err = h.send(chainHead, protocol.WinnersMessage(winners[h.agencyId]))
+			} else {
+				messages := make([]protocol.Message, 0, 2*len(h.agencies)+1)
+				messages = append(messages, chainHead)
+				for agencyId := range h.agencies {
+					messages = append(messages,
+						protocol.AgencyWinnersMessage{AgencyId: agencyId},
+						protocol.WinnersMessage(winners[agencyId]),
+					)
+				}
+				err = h.send(messages...)
+			}
 
-			return nil
+			for agencyId := range h.agencies {
+				h.server.recordAudit("deliver_winners", agencyId, auditError(map[string]any{
+					"winners":    len(winners[agencyId]),
+					"chain_head": h.server.chainHead,
+				}, err))
+			}
+			return err
 		}
 	}
 }
 
-func (h *handler) sendWinners(ctx context.Context) error {
-	lotteryFinish := make(chan struct{})
-	go func() {
-		h.server.lotteryFinish.Wait()
-		lotteryFinish <- struct{}{}
-	}()
+// Sends a keepalive probe and waits for its answer
+func (h *handler) ping() error {
+	err := h.send(protocol.PingMessage{})
+	if err != nil {
+		return err
+	}
 
-	select {
-	case <-ctx.Done():
-		return net.ErrClosed
-	case <-lotteryFinish:
-		if h.agencyId == 1 {
-			log.Info(common.FmtLog("sorteo", nil))
-		}
+	err = common.SetDeadline(h.conn.SetReadDeadline, h.server.config.ioTimeout)
+	if err != nil {
+		return err
+	}
 
-		winners, err := h.server.getWinners()
-		if err != nil {
-			return err
-		}
+	_, err = protocol.Receive[protocol.PongMessage](h.reader)
+	return err
+}
 
-		err = protocol.SendFlush(protocol.WinnersMessage(winners[h.agencyId]), h.writer)
-		if err != nil {
-			return err
-		}
+// Sends and flushes the messages, failing if they can't be written within
+// the configured timeout. Safe to call while events are being pushed.
+func (h *handler) send(messages ...protocol.Message) error {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
 
-		return nil
+	err := common.SetDeadline(h.conn.SetWriteDeadline, h.server.config.ioTimeout)
+	if err != nil {
+		return err
 	}
+
+	for _, m := range messages {
+		protocol.Send(m, h.writer)
+	}
+	return protocol.Flush(h.writer)
 }
 
-func (h *handler) receiveBatch(batchSize int) error {
-	bets := make([]lottery.Bet, 0, batchSize)
+// Maximum amount of bets of a batch, regardless of the byte budget
+const MAX_BATCH_SIZE = 10000
+
+var errInvalidBatchSize = errors.New("invalid batch size")
+
+// Receives the bets of the batch and stores them. The batch is answered
+// with its sequence number, as the agency may have sent more batches
+// after it. `headerSize` is the encoded size of the header that announced
+// the batch, which counts towards its byte budget.
+func (h *handler) receiveBatch(agencyId int, batch protocol.BatchMessage, headerSize int) error {
+	maxBytes := h.server.config.batchMaxBytes
+	size := headerSize
+
+	// the bets of the batch can't be skipped, so the connection is closed
+	if batch.BatchSize < 0 || batch.BatchSize > MAX_BATCH_SIZE {
+		sizeErr := fmt.Errorf("%w: %v bets", errInvalidBatchSize, batch.BatchSize)
+		sendErr := h.send(protocol.NackMessage{
+			Seq:    batch.Seq,
+			Reason: protocol.TooLargeReason,
+		})
+		return errors.Join(sizeErr, sendErr)
+	}
+
+	capacity := batch.BatchSize
+	if maxBytes > 0 {
+		// every bet takes at least a byte
+		capacity = min(capacity, maxBytes)
+	}
+	bets := make([]lottery.Bet, 0, capacity)
+	// kept as received, to hash the stored ones for the receipt
+	received := make([]protocol.BetMessage, 0, capacity)
+
+	for i := 0; i < batch.BatchSize; i++ {
+		// once the batch started, each bet must arrive within the timeout
+		err := common.SetDeadline(h.conn.SetReadDeadline, h.server.config.ioTimeout)
+		if err != nil {
+			return err
+		}
 
-	for i := 0; i < batchSize; i++ {
 		betMessage, err := protocol.Receive[protocol.BetMessage](h.reader)
 		if err != nil {
 			return fmt.Errorf("failed to parse bet: %w", err)
 		}
 
+		// bets over the budget are still read, to reach the next message
+		size += h.sizer.Size(betMessage)
+		if maxBytes > 0 && size > maxBytes {
+			continue
+		}
+
 		bet := lottery.Bet{
-			Agency:    h.agencyId,
+			Agency:    agencyId,
 			FirstName: betMessage.FirstName,
 			LastName:  betMessage.LastName,
 			Document:  betMessage.Document,
@@ -133,23 +443,143 @@ func (h *handler) receiveBatch(batchSize int) error {
 		}
 
 		bets = append(bets, bet)
+		received = append(received, betMessage)
+	}
+
+	if _, ok := h.agencies[agencyId]; !ok {
+		authErr := protocol.NackMessage{
+			Seq:    batch.Seq,
+			Reason: protocol.UnauthorizedReason,
+		}
+		sendErr := h.send(authErr)
+		return errors.Join(authErr, sendErr)
+	}
+
+	if maxBytes > 0 && size > maxBytes {
+		sizeErr := fmt.Errorf("batch of %v bytes exceeds the budget of %v bytes", size, maxBytes)
+		sendErr := h.send(protocol.NackMessage{
+			Seq:    batch.Seq,
+			Reason: protocol.TooLargeReason,
+		})
+		return errors.Join(sizeErr, sendErr)
 	}
 
-	h.server.storageLock.Lock()
-	storeErr := lottery.StoreBets(bets)
-	h.server.storageLock.Unlock()
+	allowed, retryAfter := h.server.agencyLimiter.take(agencyId, len(bets))
+	if !allowed {
+		h.server.stats.batchesLimited.Add(1)
+		limitErr := protocol.NackMessage{
+			Seq:    batch.Seq,
+			Reason: protocol.RateLimitedReason,
+			// rounded up, so that the bucket has refilled when retried
+			RetryAfter: int(retryAfter.Milliseconds()) + 1,
+		}
+		sendErr := h.send(limitErr)
+		return errors.Join(limitErr, sendErr)
+	}
+
+	// the batch is audited by the storage writer, once per commit
+	rejected, storeErr := h.server.storage.StoreTagged(bets, batchTag{agencyId, batch.Seq})
 	if storeErr != nil {
 		storeErr = fmt.Errorf("failed to store bets: %w", storeErr)
-		sendErr := protocol.SendFlush(protocol.ErrMessage{}, h.writer)
+		sendErr := h.send(protocol.NackMessage{
+			Seq:    batch.Seq,
+			Reason: protocol.StorageReason,
+		})
 		return errors.Join(storeErr, sendErr)
 	}
 
-	err := protocol.SendFlush(protocol.OkMessage{}, h.writer)
-	if err != nil {
-		return err
+	// the rejected bets precede the answer of the batch
+	messages := make([]protocol.Message, 0, len(rejected)+1)
+	isRejected := make(map[int]bool, len(rejected))
+	for _, rejection := range rejected {
+		isRejected[rejection.Index] = true
+		reason := rejectionReason(rejection.Err)
+		switch reason {
+		case protocol.DuplicateReason:
+			h.server.stats.duplicateBets.Add(1)
+		case protocol.BetLimitReason:
+			h.server.stats.betsOverLimit.Add(1)
+		}
+		log.Warning(common.FmtLog("reject_bet", rejection.Err,
+			"agency_id", agencyId,
+			"seq", batch.Seq,
+			"index", rejection.Index,
+			"bet", bets[rejection.Index],
+		))
+		messages = append(messages, protocol.RejectedMessage{
+			Seq:    batch.Seq,
+			Index:  rejection.Index,
+			Reason: reason,
+		})
 	}
 
-	return nil
+	// the receipt only covers the stored bets
+	stored := make([]protocol.BetMessage, 0, len(received)-len(rejected))
+	for i, bet := range received {
+		if !isRejected[i] {
+			stored = append(stored, bet)
+		}
+	}
+	receipt := protocol.Receipt{
+		RunId:    h.server.runId,
+		AgencyId: agencyId,
+		Seq:      batch.Seq,
+		Count:    len(stored),
+		Hash:     protocol.HashBets(stored),
+	}
+	if h.server.config.receiptKey != nil {
+		receipt = receipt.Sign(h.server.config.receiptKey)
+	}
+
+	messages = append(messages, protocol.AckMessage{
+		Seq:       receipt.Seq,
+		RunId:     receipt.RunId,
+		Count:     receipt.Count,
+		Hash:      receipt.Hash,
+		Signature: receipt.Signature,
+	})
+	return h.send(messages...)
+}
+
+// The bets as sent by the agency, without the agency
+func betMessages(bets []lottery.Bet) []protocol.BetMessage {
+	messages := make([]protocol.BetMessage, 0, len(bets))
+	for _, bet := range bets {
+		messages = append(messages, protocol.BetMessage{
+			FirstName: bet.FirstName,
+			LastName:  bet.LastName,
+			Document:  bet.Document,
+			Birthdate: bet.Birthdate,
+			Number:    bet.Number,
+		})
+	}
+	return messages
+}
+
+// Maps why the storage rejected a bet to the reason sent to the agency
+func rejectionReason(err error) protocol.ErrorReason {
+	if errors.Is(err, lottery.ErrDuplicate) {
+		return protocol.DuplicateReason
+	}
+	if errors.Is(err, lottery.ErrBetLimit) {
+		return protocol.BetLimitReason
+	}
+	return protocol.StorageReason
+}
+
+// Logs the bytes exchanged with the agency, before and after compression
+func (h *handler) logTraffic() {
+	sent, sentWire := h.writer.Written()
+	received, receivedWire := h.reader.Received()
+
+	log.Info(common.FmtLog("traffic", nil,
+		"agency_id", h.agencyId,
+		"compression", h.compression.Code(),
+		"bytes_sent", sent,
+		"bytes_sent_wire", sentWire,
+		"bytes_received", received,
+		"bytes_received_wire", receivedWire,
+	))
 }
 
 func closeConnection(conn net.Conn) error {
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+)
+
+func TestRejectedBets(t *testing.T) {
+	s := newTestServer(t, serverConfig{
+		duplicatePolicy: lottery.GlobalDuplicates,
+	})
+	reader, writer := connectTestClient(t, s, 1)
+
+	bet := protocol.BetMessage{
+		FirstName: "Laura",
+		LastName:  "Lopez",
+		Document:  44160273,
+		Birthdate: time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		Number:    83,
+	}
+	other := bet
+	other.Number = 84
+
+	sendBatch := func(seq int, bets ...protocol.BetMessage) []protocol.Message {
+		protocol.Send(protocol.BatchMessage{Seq: seq, BatchSize: len(bets)}, writer)
+		for _, bet := range bets {
+			protocol.Send(bet, writer)
+		}
+		_ = protocol.Flush(writer)
+
+		answers := make([]protocol.Message, 0)
+		for {
+			answer, err := protocol.ReceiveAny(reader)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			answers = append(answers, answer)
+			if _, ok := answer.(protocol.RejectedMessage); !ok {
+				return answers
+			}
+		}
+	}
+
+	// duplicates are rejected within the batch, and across batches
+	answers := sendBatch(1, bet, bet, other)
+	if len(answers) != 2 || answers[0] != (protocol.RejectedMessage{Seq: 1, Index: 1, Reason: protocol.DuplicateReason}) {
+		t.Fatalf("expected the second bet to be rejected, but got %v", answers)
+	}
+	// the receipt only covers the stored bets
+	ack, ok := answers[1].(protocol.AckMessage)
+	hash := protocol.HashBets([]protocol.BetMessage{bet, other})
+	if !ok || ack.Seq != 1 || ack.Count != 2 || ack.Hash != hash {
+		t.Fatalf("expected a receipt for the stored bets of batch 1, but got %v", answers[1])
+	}
+
+	answers = sendBatch(2, other)
+	if len(answers) != 2 || answers[0] != (protocol.RejectedMessage{Seq: 2, Index: 0, Reason: protocol.DuplicateReason}) {
+		t.Fatalf("expected the bet to be rejected, but got %v", answers)
+	}
+	ack, ok = answers[1].(protocol.AckMessage)
+	if !ok || ack.Count != 0 || ack.Hash != protocol.HashBets(nil) {
+		t.Fatalf("expected an empty receipt for batch 2, but got %v", answers[1])
+	}
+
+	bets, err := s.storage.Load()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(bets) != 2 || s.stats.duplicateBets.Load() != 2 {
+		t.Fatalf("expected 2 bets stored and 2 duplicates, but got %v and %v", len(bets), s.stats.duplicateBets.Load())
+	}
+}
+
+func TestBetLimitRejected(t *testing.T) {
+	s := newTestServer(t, serverConfig{
+		maxBetsPerDocument: 1,
+	})
+	reader, writer := connectTestClient(t, s, 1)
+
+	bet := protocol.BetMessage{
+		FirstName: "Laura",
+		LastName:  "Lopez",
+		Document:  44160273,
+		Birthdate: time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		Number:    83,
+	}
+	other := bet
+	other.Number = 84
+
+	protocol.Send(protocol.BatchMessage{Seq: 1, BatchSize: 2}, writer)
+	protocol.Send(bet, writer)
+	_ = protocol.SendFlush(other, writer)
+
+	rejection, err := protocol.Receive[protocol.RejectedMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if rejection != (protocol.RejectedMessage{Seq: 1, Index: 1, Reason: protocol.BetLimitReason}) {
+		t.Fatalf("expected the second bet to be over the limit, but got %v", rejection)
+	}
+	_, err = protocol.Receive[protocol.AckMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.stats.betsOverLimit.Load() != 1 {
+		t.Fatalf("expected 1 bet over the limit, but got %v", s.stats.betsOverLimit.Load())
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := newTestServer(t, serverConfig{
+		idleTimeout: 100 * time.Millisecond,
+	})
+	reader, _ := connectTestClient(t, s, 1)
+
+	// the agency stays silent after the handshake
+	_, err := protocol.ReceiveAny(reader)
+	if err == nil {
+		t.Fatalf("expected the session to be closed")
+	}
+	if timeouts := s.stats.sessionTimeouts.Load(); timeouts != 1 {
+		t.Fatalf("expected 1 session timeout, but got %v", timeouts)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	s := newTestServer(t, serverConfig{
+		ioTimeout:       100 * time.Millisecond,
+		keepalivePeriod: 20 * time.Millisecond,
+	})
+	reader, writer := connectTestClient(t, s, 1)
+
+	// the draw waits for the other agencies, so the agency is probed
+	_ = protocol.SendFlush(protocol.FinishMessage{}, writer)
+	for i := 0; i < 3; i++ {
+		_, err := protocol.Receive[protocol.PingMessage](reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		_ = protocol.SendFlush(protocol.PongMessage{}, writer)
+	}
+	if timeouts := s.stats.sessionTimeouts.Load(); timeouts != 0 {
+		t.Fatalf("expected no session timeouts, but got %v", timeouts)
+	}
+
+	// an unanswered probe closes the session
+	_, err := protocol.Receive[protocol.PingMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = protocol.ReceiveAny(reader)
+	if err == nil {
+		t.Fatalf("expected the session to be closed")
+	}
+	if timeouts := s.stats.sessionTimeouts.Load(); timeouts != 1 {
+		t.Fatalf("expected 1 session timeout, but got %v", timeouts)
+	}
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	bet := protocol.BetMessage{
+		FirstName: "Laura",
+		LastName:  "Lopez",
+		Document:  44160273,
+		Birthdate: time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		Number:    83,
+	}
+	codec, _ := protocol.LookupCodec(protocol.CsvCode)
+	sizer := protocol.NewSizer(codec)
+	header := protocol.BatchMessage{Seq: 1, BatchSize: 1}
+
+	// fits a single bet, announced by a `BatchMessage`
+	s := newTestServer(t, serverConfig{
+		batchMaxBytes: sizer.Size(header) + sizer.Size(bet),
+		hubs:          map[int][]int{100: {2}},
+	})
+	reader, writer := connectTestClient(t, s, 1)
+
+	sendBatch := func(seq int, bets ...protocol.BetMessage) protocol.Message {
+		protocol.Send(protocol.BatchMessage{Seq: seq, BatchSize: len(bets)}, writer)
+		for _, bet := range bets {
+			protocol.Send(bet, writer)
+		}
+		_ = protocol.Flush(writer)
+		answer, err := protocol.ReceiveAny(reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return answer
+	}
+
+	answer := sendBatch(1, bet)
+	if ack, ok := answer.(protocol.AckMessage); !ok || ack.Seq != 1 {
+		t.Fatalf("expected batch 1 to be stored, but got %v", answer)
+	}
+	// the bets over the budget are read, so the connection may go on
+	answer = sendBatch(2, bet, bet)
+	if answer != (protocol.NackMessage{Seq: 2, Reason: protocol.TooLargeReason}) {
+		t.Fatalf("expected batch 2 to be too large, but got %v", answer)
+	}
+	answer = sendBatch(3, bet)
+	if ack, ok := answer.(protocol.AckMessage); !ok || ack.Seq != 3 {
+		t.Fatalf("expected batch 3 to be stored, but got %v", answer)
+	}
+
+	// the header of a hub is larger, and counts towards the budget
+	hubReader, hubWriter := connectTestClient(t, s, 100)
+	protocol.Send(protocol.AgencyBatchMessage{AgencyId: 2, Seq: 1, BatchSize: 1}, hubWriter)
+	_ = protocol.SendFlush(bet, hubWriter)
+	answer, err := protocol.ReceiveAny(hubReader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if answer != (protocol.NackMessage{Seq: 1, Reason: protocol.TooLargeReason}) {
+		t.Fatalf("expected the hub batch to be too large, but got %v", answer)
+	}
+}
+
+func TestInvalidBatchSize(t *testing.T) {
+	s := newTestServer(t, serverConfig{})
+
+	for _, batchSize := range []int{-1, MAX_BATCH_SIZE + 1} {
+		reader, writer := connectTestClient(t, s, 1)
+
+		// the bets can't be skipped, so the connection is closed
+		_ = protocol.SendFlush(protocol.BatchMessage{Seq: 1, BatchSize: batchSize}, writer)
+		answer, err := protocol.ReceiveAny(reader)
+		if answer != (protocol.NackMessage{Seq: 1, Reason: protocol.TooLargeReason}) {
+			t.Fatalf("expected a batch of %v bets to be invalid, but got %v, %v", batchSize, answer, err)
+		}
+		_, err = protocol.ReceiveAny(reader)
+		if err == nil {
+			t.Fatalf("expected the connection to be closed")
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	// two bets at once, and one more per second
+	s := newTestServer(t, serverConfig{
+		agencyRateLimit: 1,
+		agencyRateBurst: 2,
+	})
+	reader, writer := connectTestClient(t, s, 1)
+
+	bet := protocol.BetMessage{
+		FirstName: "Laura",
+		LastName:  "Lopez",
+		Document:  44160273,
+		Birthdate: time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		Number:    83,
+	}
+	sendBatch := func(seq int) protocol.Message {
+		protocol.Send(protocol.BatchMessage{Seq: seq, BatchSize: 2}, writer)
+		protocol.Send(bet, writer)
+		_ = protocol.SendFlush(bet, writer)
+		answer, err := protocol.ReceiveAny(reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return answer
+	}
+
+	answer := sendBatch(1)
+	if ack, ok := answer.(protocol.AckMessage); !ok || ack.Seq != 1 {
+		t.Fatalf("expected batch 1 to be stored, but got %v", answer)
+	}
+
+	// the agency is told when the bucket will have refilled
+	answer = sendBatch(2)
+	nack, ok := answer.(protocol.NackMessage)
+	if !ok || nack.Seq != 2 || nack.Reason != protocol.RateLimitedReason {
+		t.Fatalf("expected batch 2 to be rate limited, but got %v", answer)
+	}
+	if nack.RetryAfter <= 0 || nack.RetryAfter > 2001 {
+		t.Fatalf("expected to retry within 2s, but got %vms", nack.RetryAfter)
+	}
+	if limited := s.stats.batchesLimited.Load(); limited != 1 {
+		t.Fatalf("expected 1 batch limited, but got %v", limited)
+	}
+}
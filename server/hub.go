@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parses the agencies that each hub is authorized for, with the format
+// `hub:agency,agency,...;hub:agency,...`. Hubs may also be separated by
+// `|`, as `config.ini` treats `;` as the start of a comment. Empty entries
+// are ignored. Agencies must be between 1 and MAX_AGENCIES, as each one
+// counts towards the draw, and belong to a single hub. Hub ids can't be
+// agency ids, or the hub would act as that agency.
+func parseHubs(hubs string) (map[int][]int, error) {
+	parsed := make(map[int][]int)
+	// hub of each agency
+	hubOf := make(map[int]int)
+
+	separator := func(r rune) bool {
+		return r == ';' || r == '|'
+	}
+	for _, entry := range strings.FieldsFunc(hubs, separator) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		hub, agencies, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid hub %q, expected `hub:agency,...`", entry)
+		}
+
+		hubId, err := strconv.Atoi(strings.TrimSpace(hub))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hub %q: %w", entry, err)
+		}
+		if _, ok := parsed[hubId]; ok {
+			return nil, fmt.Errorf("hub %v is configured twice", hubId)
+		}
+		if validAgency(hubId) {
+			return nil, fmt.Errorf("invalid hub %q: hub %v is an agency id", entry, hubId)
+		}
+
+		agencyIds := make([]int, 0)
+		for _, agency := range strings.Split(agencies, ",") {
+			agencyId, err := strconv.Atoi(strings.TrimSpace(agency))
+			if err != nil {
+				return nil, fmt.Errorf("invalid hub %q: %w", entry, err)
+			}
+			if !validAgency(agencyId) {
+				return nil, fmt.Errorf("invalid hub %q: agency %v is not between 1 and %v", entry, agencyId, MAX_AGENCIES)
+			}
+			if otherHub, ok := hubOf[agencyId]; ok {
+				return nil, fmt.Errorf("invalid hub %q: agency %v already belongs to hub %v", entry, agencyId, otherHub)
+			}
+			hubOf[agencyId] = hubId
+			agencyIds = append(agencyIds, agencyId)
+		}
+		parsed[hubId] = agencyIds
+	}
+
+	return parsed, nil
+}
+
+// Returns true if the id belongs to one of the agencies of the draw
+func validAgency(agencyId int) bool {
+	return agencyId >= 1 && agencyId <= MAX_AGENCIES
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+)
+
+func TestParseHubs(t *testing.T) {
+	hubs, err := parseHubs(" 100:1,2,3 ; 101: 4 |")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := map[int][]int{100: {1, 2, 3}, 101: {4}}
+	if !reflect.DeepEqual(hubs, expected) {
+		t.Fatalf("expected %v, but got %v", expected, hubs)
+	}
+
+	for _, invalid := range []string{"100", "100:", "hub:1", "100:1;100:2", "100:0", "100:1,6", "1:2,3", "5:1", "100:1;101:1", "100:2,2"} {
+		_, err := parseHubs(invalid)
+		if err == nil {
+			t.Fatalf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+// Creates a server without listeners, with a running storage and draw
+func newTestServer(t *testing.T, config serverConfig) *server {
+	storage := lottery.NewStorage(filepath.Join(t.TempDir(), "bets.csv"))
+	storage.SetDuplicatePolicy(config.duplicatePolicy)
+	storage.SetMaxBetsPerDocument(config.maxBetsPerDocument)
+
+	lotteryFinish := &sync.WaitGroup{}
+	lotteryFinish.Add(MAX_AGENCIES)
+
+	s := &server{
+		config:         config,
+		runId:          "000102030405060708090a0b0c0d0e0f",
+		storage:        storage,
+		lotteryFinish:  lotteryFinish,
+		finished:       make(map[int]bool),
+		finishedLock:   &sync.Mutex{},
+		drawDone:       make(chan struct{}),
+		events:         newEvents(),
+		activeHandlers: &sync.WaitGroup{},
+		stats:          &stats{},
+		agencyLimiter:  newRateLimiter[int](config.agencyRateLimit, config.agencyRateBurst),
+		authLimiter:    newRateLimiter[string](config.authFailureRate, config.authFailureBurst),
+	}
+	if config.maxConnections > 0 {
+		s.connections = make(chan struct{}, config.maxConnections)
+	}
+	storage.SetCommitHook(s.auditCommit)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- storage.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go s.draw()
+
+	return s
+}
+
+// Connects to the server in memory, and completes the handshake
+func connectTestClient(t *testing.T, s *server, agencyId int) (*protocol.Reader, *protocol.Writer) {
+	conn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go s.handleClient(context.Background(), serverConn)
+
+	reader := protocol.NewReader(conn)
+	writer := protocol.NewWriter(conn)
+
+	_ = protocol.SendFlush(protocol.HelloMessage{
+		AgencyId:    agencyId,
+		Codec:       protocol.CsvCode,
+		Compression: protocol.NoCompression,
+	}, writer)
+	_, err := protocol.Receive[protocol.OkMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	return reader, writer
+}
+
+func TestHub(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	s := newTestServer(t, serverConfig{
+		hubs:       map[int][]int{100: {1, 2, 3, 4, 5}},
+		receiptKey: private,
+	})
+
+	reader, writer := connectTestClient(t, s, 100)
+
+	winner := protocol.BetMessage{
+		FirstName: "Laura",
+		LastName:  "Lopez",
+		Document:  44160273,
+		Birthdate: time.Date(2002, time.May, 16, 0, 0, 0, 0, time.UTC),
+		Number:    lottery.LOTTERY_WINNER_NUMBER,
+	}
+	loser := winner
+	loser.Number = 1
+
+	// the hub may only send bets for its agencies
+	sendBatch := func(agencyId int) protocol.Message {
+		protocol.Send(protocol.AgencyBatchMessage{AgencyId: agencyId, Seq: agencyId, BatchSize: 2}, writer)
+		protocol.Send(winner, writer)
+		protocol.Send(loser, writer)
+		_ = protocol.Flush(writer)
+
+		answer, err := protocol.ReceiveAny(reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return answer
+	}
+
+	answer := sendBatch(2)
+	ack, ok := answer.(protocol.AckMessage)
+	if !ok || ack.Seq != 2 {
+		t.Fatalf("expected batch 2 to be stored, but got %v", answer)
+	}
+
+	// the receipt is issued to the agency, not to the hub
+	receipt := protocol.Receipt{
+		RunId:     s.runId,
+		AgencyId:  2,
+		Seq:       ack.Seq,
+		Count:     2,
+		Hash:      protocol.HashBets([]protocol.BetMessage{winner, loser}),
+		Signature: ack.Signature,
+	}
+	if ack.RunId != receipt.RunId || ack.Count != receipt.Count || ack.Hash != receipt.Hash || !receipt.Verify(public) {
+		t.Fatalf("expected a valid receipt for agency 2, but got %v", ack)
+	}
+	answer = sendBatch(6)
+	if answer != (protocol.NackMessage{Seq: 6, Reason: protocol.UnauthorizedReason}) {
+		t.Fatalf("expected batch 6 to be unauthorized, but got %v", answer)
+	}
+
+	// finishing twice counts once
+	for _, agencyId := range []int{1, 1, 2, 3, 4, 5} {
+		_ = protocol.SendFlush(protocol.AgencyFinishMessage{AgencyId: agencyId}, writer)
+	}
+
+	// the winners are preceded by the head of the store at the draw
+	chainHead, err := protocol.Receive[protocol.ChainHeadMessage](reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	chain, err := s.storage.Verify()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if chainHead.Head != chain.Head || chain.Blocks != 1 {
+		t.Fatalf("expected head %v after 1 block, but got %v", chain, chainHead.Head)
+	}
+
+	winners := make(map[int]protocol.WinnersMessage)
+	for i := 0; i < 5; i++ {
+		header, err := protocol.Receive[protocol.AgencyWinnersMessage](reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		winners[header.AgencyId], err = protocol.Receive[protocol.WinnersMessage](reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	for agencyId := 1; agencyId <= 5; agencyId++ {
+		expected := protocol.WinnersMessage{}
+		if agencyId == 2 {
+			expected = protocol.WinnersMessage{winner.Document}
+		}
+		if !slices.Equal(winners[agencyId], expected) {
+			t.Fatalf("agency %v: expected winners %v, but got %v", agencyId, expected, winners[agencyId])
+		}
+	}
+}
+
+func TestUnknownAgency(t *testing.T) {
+	s := newTestServer(t, serverConfig{})
+
+	conn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go s.handleClient(context.Background(), serverConn)
+
+	// it would count towards the draw, as if it were one of the agencies
+	_ = protocol.SendFlush(protocol.HelloMessage{
+		AgencyId:    MAX_AGENCIES + 1,
+		Codec:       protocol.CsvCode,
+		Compression: protocol.NoCompression,
+	}, protocol.NewWriter(conn))
+	_, err := protocol.Receive[protocol.OkMessage](protocol.NewReader(conn))
+	if err != (protocol.ErrMessage{Reason: protocol.UnauthorizedReason}) {
+		t.Fatalf("expected the agency to be unauthorized, but got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
+)
+
+// Creates a listener for each of the configured addresses. The socket
+// options only apply to TCP and unix listeners. If TLS is enabled, it is
+// layered on top of every listener.
+func listen(config serverConfig) ([]net.Listener, error) {
+	listenConfig := net.ListenConfig{
+		KeepAlive: config.tcpKeepalive,
+		Control: func(_, _ string, conn syscall.RawConn) error {
+			return setSocketOptions(conn, config)
+		},
+	}
+
+	listeners := make([]net.Listener, 0, len(config.addresses))
+	for _, address := range config.addresses {
+		listener, err := transport.Listen(context.Background(), listenConfig, address)
+		if err == nil {
+			err = setListenBacklog(listener, config.listenBacklog)
+		}
+		if err == nil && config.tls != nil {
+			listener = tls.NewListener(listener, config.tls)
+		}
+		if err != nil {
+			for _, listener := range listeners {
+				err = errors.Join(err, listener.Close())
+			}
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// Returns the addresses to listen on, given as a comma separated list
+// of `scheme://address` (see `transport`). If there are none, listens on
+// TCP on each of the IPs, which may be hostnames, IPv4 or IPv6 addresses.
+// If there are no IPs either, listens on all the interfaces.
+func listenAddresses(addresses string, ips string, port int) ([]transport.Address, error) {
+	parsed := make([]transport.Address, 0)
+	for _, address := range parseAddresses(addresses) {
+		address, err := transport.ParseAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, address)
+	}
+	if len(parsed) > 0 {
+		return parsed, nil
+	}
+
+	hosts := parseAddresses(ips)
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+	for _, host := range hosts {
+		parsed = append(parsed, transport.Address{
+			Network: transport.TCP,
+			Address: net.JoinHostPort(host, strconv.Itoa(port)),
+		})
+	}
+
+	return parsed, nil
+}
+
+// Parses a comma separated list of addresses, ignoring empty entries
+func parseAddresses(addresses string) []string {
+	parsed := make([]string, 0)
+	for _, address := range strings.Split(addresses, ",") {
+		address = strings.TrimSpace(address)
+		if address != "" {
+			parsed = append(parsed, address)
+		}
+	}
+	return parsed
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
+)
+
+func TestListenAddresses(t *testing.T) {
+	tcp := func(address string) transport.Address {
+		return transport.Address{Network: transport.TCP, Address: address}
+	}
+
+	cases := []struct {
+		addresses string
+		ips       string
+		expected  []transport.Address
+	}{
+		// every interface
+		{"", "", []transport.Address{tcp(":12345")}},
+		{"", "127.0.0.1", []transport.Address{tcp("127.0.0.1:12345")}},
+		{"", "::1", []transport.Address{tcp("[::1]:12345")}},
+		{"", " 127.0.0.1, ::1 ,server", []transport.Address{
+			tcp("127.0.0.1:12345"),
+			tcp("[::1]:12345"),
+			tcp("server:12345"),
+		}},
+		// explicit addresses take precedence over the IPs
+		{"tcp://[::1]:80, unix:///tmp/server.sock,pipe://server,10.0.0.1:81", "127.0.0.1", []transport.Address{
+			tcp("[::1]:80"),
+			{Network: transport.Unix, Address: "/tmp/server.sock"},
+			{Network: transport.Pipe, Address: "server"},
+			tcp("10.0.0.1:81"),
+		}},
+	}
+	for _, c := range cases {
+		addresses, err := listenAddresses(c.addresses, c.ips, 12345)
+		if err != nil {
+			t.Fatalf("%q, %q: %v", c.addresses, c.ips, err)
+		}
+		if !reflect.DeepEqual(addresses, c.expected) {
+			t.Fatalf("%q, %q: expected %v, but got %v", c.addresses, c.ips, c.expected, addresses)
+		}
+	}
+
+	_, err := listenAddresses("udp://127.0.0.1:80", "", 12345)
+	if err == nil {
+		t.Fatalf("expected an unknown transport to be invalid")
+	}
+}
+
+func TestListen(t *testing.T) {
+	addresses := []transport.Address{
+		{Network: transport.TCP, Address: "127.0.0.1:0"},
+		{Network: transport.Unix, Address: filepath.Join(t.TempDir(), "server.sock")},
+		{Network: transport.Pipe, Address: "listen-test"},
+	}
+	if listener, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		_ = listener.Close()
+		addresses = append(addresses, transport.Address{Network: transport.TCP, Address: "[::1]:0"})
+	}
+
+	listeners, err := listen(serverConfig{
+		addresses:     addresses,
+		listenBacklog: 2,
+		reuseAddress:  true,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	})
+	if len(listeners) != len(addresses) {
+		t.Fatalf("expected %v listeners, but got %v", len(addresses), len(listeners))
+	}
+
+	// each listener still accepts connections once configured
+	for i, listener := range listeners {
+		address := addresses[i]
+		if address.Network != transport.Pipe {
+			address.Address = listener.Addr().String()
+		}
+
+		accepted := make(chan error, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				_ = conn.Close()
+			}
+			accepted <- err
+		}()
+
+		conn, err := transport.Dial(context.Background(), address)
+		if err != nil {
+			t.Fatalf("%v: %v", address, err)
+		}
+		_ = conn.Close()
+		err = <-accepted
+		if err != nil {
+			t.Fatalf("%v: %v", address, err)
+		}
+	}
+}
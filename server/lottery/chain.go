@@ -0,0 +1,174 @@
+package lottery
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+)
+
+// The store is a hash chain of batches. After the bets of each batch, a
+// block line `BLOCK,<count>,<hash>` is written, where the hash is the
+// SHA-256 of the hash of the previous block followed by the lines of the
+// batch. Editing, removing or reordering stored bets changes the hash of
+// every following block, so it is noticed by `VerifyChain`.
+
+const BLOCK_TAG = "BLOCK"
+
+// Hash that the first block chains to
+var GENESIS_HASH = strings.Repeat("0", 2*sha256.Size)
+
+// State of the chain after its last block
+type Chain struct {
+	Head   string
+	Blocks int
+	Bets   int
+}
+
+// Returned by `VerifyChain` at the first line that breaks the chain
+type ChainError struct {
+	Line   int
+	Block  int
+	Reason string
+}
+
+func (e ChainError) Error() string {
+	return fmt.Sprintf("chain broken at line %v, block %v: %v", e.Line, e.Block, e.Reason)
+}
+
+// Appends the batch followed by its block, and returns the new head.
+// If there is a keyring, the batch is sealed.
+func appendBlock(buf *bytes.Buffer, head string, bets []Bet, keyring *Keyring) (string, error) {
+	start := buf.Len()
+	err := storeBatch(buf, bets, keyring)
+	if err != nil {
+		return head, err
+	}
+
+	hash := newChainHash(head)
+	hash.Write(buf.Bytes()[start:])
+	head = hex.EncodeToString(hash.Sum(nil))
+
+	writer := safeio.NewWriter(buf)
+	writer.Write([]string{BLOCK_TAG, strconv.Itoa(len(bets)), head})
+	return head, writer.Flush()
+}
+
+func storeBatch(buf *bytes.Buffer, bets []Bet, keyring *Keyring) error {
+	if keyring == nil {
+		return StoreBetsIn(buf, bets)
+	}
+
+	var plain bytes.Buffer
+	err := StoreBetsIn(&plain, bets)
+	if err != nil {
+		return err
+	}
+	record, err := keyring.seal(plain.Bytes(), len(bets))
+	if err != nil {
+		return err
+	}
+
+	writer := safeio.NewWriter(buf)
+	writer.Write(record)
+	return writer.Flush()
+}
+
+func newChainHash(head string) hash.Hash {
+	hash := sha256.New()
+	hash.Write([]byte(head))
+	return hash
+}
+
+// Walks the whole store, checking the hash of every block. Bets after
+// the last block were not committed, so they break the chain too. Sealed
+// batches are not opened, so no keys are needed.
+func VerifyChain(r io.Reader) (Chain, error) {
+	reader := safeio.NewReader(r)
+	chain := Chain{Head: GENESIS_HASH}
+	hash := newChainHash(chain.Head)
+	// bets of the current block, and the line where it started
+	count := 0
+	start := 1
+
+	for line := 1; ; line++ {
+		raw, err := reader.ReadLine()
+		if errors.Is(err, io.EOF) {
+			if count > 0 {
+				return chain, ChainError{start, chain.Blocks + 1, fmt.Sprintf("%v bets after the last block", count)}
+			}
+			return chain, nil
+		}
+		if err != nil {
+			return chain, err
+		}
+		record := strings.Split(string(raw), ",")
+
+		switch record[0] {
+		case BLOCK_TAG:
+		case SEALED_TAG:
+			sealed, err := sealedCount(record)
+			if err != nil {
+				return chain, ChainError{line, chain.Blocks + 1, fmt.Sprintf("invalid sealed batch: %v", err)}
+			}
+			hash.Write(raw)
+			hash.Write([]byte{'\n'})
+			count += sealed
+			continue
+		default:
+			_, err := protocol.Deserialize[Bet](record)
+			if err != nil {
+				return chain, ChainError{line, chain.Blocks + 1, fmt.Sprintf("invalid bet: %v", err)}
+			}
+			hash.Write(raw)
+			hash.Write([]byte{'\n'})
+			count++
+			continue
+		}
+
+		if len(record) != 3 {
+			return chain, ChainError{line, chain.Blocks + 1, "invalid block"}
+		}
+		if record[1] != strconv.Itoa(count) {
+			return chain, ChainError{line, chain.Blocks + 1, fmt.Sprintf("expected %v bets, found %v", record[1], count)}
+		}
+		expected := hex.EncodeToString(hash.Sum(nil))
+		if record[2] != expected {
+			return chain, ChainError{line, chain.Blocks + 1, fmt.Sprintf("expected hash %v, found %v", expected, record[2])}
+		}
+
+		chain.Head = expected
+		chain.Blocks++
+		chain.Bets += count
+		hash = newChainHash(chain.Head)
+		count = 0
+		start = line + 1
+	}
+}
+
+// Verifies the chain of the store at `path`. A missing store is an empty
+// chain.
+func VerifyChainAt(path string) (chain Chain, err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Chain{Head: GENESIS_HASH}, nil
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := file.Close()
+		err = errors.Join(err, closeErr)
+	}()
+
+	return VerifyChain(file)
+}
@@ -0,0 +1,124 @@
+package lottery_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+)
+
+// Runs the storage until each batch is stored
+func storeChainIn(t *testing.T, storage *lottery.Storage, batches ...[]lottery.Bet) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- storage.Run(ctx)
+	}()
+	for _, batch := range batches {
+		_, err := storage.Store(batch)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	cancel()
+	err := <-done
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// Stores each batch in a new store, returning its lines
+func storeChain(t *testing.T, batches ...[]lottery.Bet) (string, []string) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	storeChainIn(t, lottery.NewStorage(path), batches...)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return path, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func verifyLines(lines []string) (lottery.Chain, error) {
+	return lottery.VerifyChain(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+}
+
+func TestChain(t *testing.T) {
+	path, lines := storeChain(t, makeBets(1, 2), makeBets(2, 3))
+
+	// 2 bets, a block, 3 bets and a block
+	if len(lines) != 7 || !strings.HasPrefix(lines[2], lottery.BLOCK_TAG) {
+		t.Fatalf("unexpected store %v", lines)
+	}
+	chain, err := verifyLines(lines)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if chain.Blocks != 2 || chain.Bets != 5 || chain.Head != strings.Split(lines[6], ",")[2] {
+		t.Fatalf("unexpected chain %+v", chain)
+	}
+
+	// a restarted storage extends the same chain
+	storage := lottery.NewStorage(path)
+	runStorage(t, storage)
+	_, err = storage.Store(makeBets(3, 1))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	extended, err := storage.Verify()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if extended.Blocks != 3 {
+		t.Fatalf("expected 3 blocks, but got %+v", extended)
+	}
+}
+
+func TestChainTampered(t *testing.T) {
+	_, lines := storeChain(t, makeBets(1, 2), makeBets(2, 3))
+
+	edited := func(edit func(lines []string) []string) []string {
+		return edit(append([]string(nil), lines...))
+	}
+	cases := []struct {
+		name  string
+		lines []string
+		// line and block of the first break
+		line  int
+		block int
+	}{
+		{"edited bet", edited(func(l []string) []string {
+			l[3] = strings.Replace(l[3], "laura", "maria", 1)
+			return l
+		}), 7, 2},
+		{"removed bet", edited(func(l []string) []string {
+			return append(l[:1], l[2:]...)
+		}), 2, 1},
+		{"swapped blocks", edited(func(l []string) []string {
+			return append(l[3:], l[:3]...)
+		}), 4, 1},
+		{"unsealed bets", edited(func(l []string) []string {
+			return append(l, l[0])
+		}), 8, 3},
+		{"invalid bet", edited(func(l []string) []string {
+			l[0] = "1,laura"
+			return l
+		}), 1, 1},
+	}
+
+	for _, c := range cases {
+		_, err := verifyLines(c.lines)
+
+		var chainErr lottery.ChainError
+		if !errors.As(err, &chainErr) {
+			t.Fatalf("%v: expected a broken chain, but got %v", c.name, err)
+		}
+		if chainErr.Line != c.line || chainErr.Block != c.block {
+			t.Errorf("%v: expected a break at line %v, block %v, but got %v", c.name, c.line, c.block, chainErr)
+		}
+	}
+}
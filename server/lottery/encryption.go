@@ -0,0 +1,144 @@
+package lottery
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// In encrypted mode, the bets of each batch are sealed with AES-GCM into
+// a single record, `SEALED,<keyId>,<count>,<nonce>,<ciphertext>`, which
+// is followed by its block as usual. The header is authenticated along
+// with the bets, and the chain hashes the sealed record, so it can be
+// verified without the key. Each record names its key, so that keys can
+// be rotated without rewriting the store.
+
+const SEALED_TAG = "SEALED"
+
+var ErrUnknownKey = errors.New("unknown storage key")
+
+// Keys that seal and open the stored batches, by id. New batches are
+// sealed with the active key.
+type Keyring struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// Parses a keyring with the format `id:key,id:key...`, where each key is
+// 16, 24 or 32 bytes hex encoded (AES-128, AES-192 or AES-256). Entries
+// may also be separated by line breaks, as in a key file. If `active` is
+// empty, the last key is the active one.
+func ParseKeyring(keys string, active string) (*Keyring, error) {
+	keyring := &Keyring{keys: make(map[string]cipher.AEAD)}
+
+	separator := func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	}
+	for _, entry := range strings.FieldsFunc(keys, separator) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, key, ok := strings.Cut(entry, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			// the entry is not logged, as it may be a key
+			return nil, errors.New("invalid storage key, expected `id:key`")
+		}
+		if _, ok := keyring.keys[id]; ok {
+			return nil, fmt.Errorf("storage key %q is configured twice", id)
+		}
+
+		aead, err := newAead(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage key %q: %w", id, err)
+		}
+		keyring.keys[id] = aead
+		keyring.active = id
+	}
+
+	if len(keyring.keys) == 0 {
+		return nil, errors.New("no storage keys")
+	}
+	if active != "" {
+		if _, ok := keyring.keys[active]; !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownKey, active)
+		}
+		keyring.active = active
+	}
+
+	return keyring, nil
+}
+
+func newAead(hexKey string) (cipher.AEAD, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seals the serialized bets of a batch with the active key
+func (k *Keyring) seal(bets []byte, count int) ([]string, error) {
+	aead := k.keys[k.active]
+	header := []string{SEALED_TAG, k.active, strconv.Itoa(count)}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := aead.Seal(nil, nonce, bets, []byte(strings.Join(header, ",")))
+
+	return append(header,
+		hex.EncodeToString(nonce),
+		base64.StdEncoding.EncodeToString(ciphertext),
+	), nil
+}
+
+// Opens a sealed record, returning the serialized bets of the batch.
+// Fails if the record was modified, or its key is not in the keyring.
+func (k *Keyring) open(record []string) ([]byte, error) {
+	_, err := sealedCount(record)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, ok := k.keys[record[1]]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, record[1])
+	}
+	nonce, err := hex.DecodeString(record[3])
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(record[4])
+	if err != nil {
+		return nil, err
+	}
+
+	header := strings.Join(record[:3], ",")
+	return aead.Open(nil, nonce, ciphertext, []byte(header))
+}
+
+// Returns the amount of bets of a sealed record, without opening it
+func sealedCount(record []string) (int, error) {
+	if len(record) != 5 {
+		return 0, errors.New("invalid sealed record")
+	}
+	return strconv.Atoi(record[2])
+}
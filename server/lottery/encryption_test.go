@@ -0,0 +1,161 @@
+package lottery_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+)
+
+const (
+	KEY_A = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	KEY_B = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func parseKeyring(t *testing.T, keys string, active string) *lottery.Keyring {
+	keyring, err := lottery.ParseKeyring(keys, active)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return keyring
+}
+
+// Replaces the first character of a base64 string with another one
+func flipFirst(s string) string {
+	if s[0] == 'A' {
+		return "B" + s[1:]
+	}
+	return "A" + s[1:]
+}
+
+func TestParseKeyring(t *testing.T) {
+	parseKeyring(t, "a:"+KEY_A+"\nb:"+KEY_B+"\n", "")
+	parseKeyring(t, "a:"+KEY_A+", b:"+KEY_B, "a")
+
+	invalid := []struct {
+		keys   string
+		active string
+	}{
+		{"", ""},
+		{KEY_A, ""},
+		{"a:00ff", ""},
+		{"a:" + KEY_A + ",a:" + KEY_B, ""},
+		{"a:" + KEY_A, "b"},
+	}
+	for _, c := range invalid {
+		_, err := lottery.ParseKeyring(c.keys, c.active)
+		if err == nil {
+			t.Fatalf("expected %q (active %q) to be invalid", c.keys, c.active)
+		}
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	bets := makeBets(1, 10)
+
+	storage := lottery.NewEncryptedStorage(path, parseKeyring(t, "a:"+KEY_A, ""))
+	runStorage(t, storage)
+	_, err := storage.Store(bets[:5])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = storage.Store(bets[5:])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, bet := range bets {
+		for _, pii := range []string{bet.FirstName, bet.LastName, strconv.Itoa(bet.Document)} {
+			if strings.Contains(string(data), pii) {
+				t.Fatalf("the store contains %q in plaintext", pii)
+			}
+		}
+	}
+
+	loaded, err := storage.Load()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(loaded, bets) {
+		t.Fatalf("expected %v, but got %v", bets, loaded)
+	}
+
+	// the chain is verified without the key
+	chain, err := storage.Verify()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if chain.Blocks != 2 || chain.Bets != 10 {
+		t.Fatalf("expected 2 blocks with 10 bets, but got %+v", chain)
+	}
+}
+
+func TestEncryptedStorageRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+
+	// bets stored in plaintext, and with each key
+	_ = os.WriteFile(path, nil, 0o666)
+	stores := []*lottery.Storage{
+		lottery.NewStorage(path),
+		lottery.NewEncryptedStorage(path, parseKeyring(t, "a:"+KEY_A, "")),
+		lottery.NewEncryptedStorage(path, parseKeyring(t, "a:"+KEY_A+",b:"+KEY_B, "b")),
+	}
+	expected := make([]lottery.Bet, 0)
+	for i, storage := range stores {
+		storeChainIn(t, storage, makeBets(i, 3))
+		expected = append(expected, makeBets(i, 3)...)
+	}
+
+	loaded, err := stores[2].Load()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Fatalf("expected %v, but got %v", expected, loaded)
+	}
+
+	// the batch sealed with `a` can't be opened without it
+	_, err = lottery.NewEncryptedStorage(path, parseKeyring(t, "b:"+KEY_B, "")).Load()
+	if !errors.Is(err, lottery.ErrUnknownKey) {
+		t.Fatalf("expected %v, but got %v", lottery.ErrUnknownKey, err)
+	}
+	_, err = lottery.NewStorage(path).Load()
+	if err == nil {
+		t.Fatalf("expected sealed batches to fail without keys")
+	}
+}
+
+func TestEncryptedStorageTampered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	keyring := parseKeyring(t, "a:"+KEY_A, "")
+	storeChainIn(t, lottery.NewEncryptedStorage(path, keyring), makeBets(1, 3))
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(string(data), "\n")
+	record := strings.Split(lines[0], ",")
+
+	// the header is authenticated too
+	tampered := map[string][]string{
+		"count":      {record[0], record[1], "4", record[3], record[4]},
+		"ciphertext": {record[0], record[1], record[2], record[3], flipFirst(record[4])},
+	}
+	for name, record := range tampered {
+		lines[0] = strings.Join(record, ",")
+		_ = os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o666)
+
+		_, err := lottery.NewEncryptedStorage(path, keyring).Load()
+		if err == nil {
+			t.Fatalf("%v: expected a tampered batch to fail", name)
+		}
+	}
+}
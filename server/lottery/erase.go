@@ -0,0 +1,183 @@
+package lottery
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+)
+
+// Replaces the names of erased bettors
+const ERASED_NAME = "ANONIMIZADO"
+
+// Replaces the birthdate of erased bettors
+var ERASED_BIRTHDATE = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Result of `EraseDocument`
+type Erasure struct {
+	// replaces the document in the anonymized bets
+	Pseudonym int
+	Bets      int
+	OldHead   string
+	NewHead   string
+}
+
+// Anonymizes every bet of the document in the store at `path`. The agency
+// and number of each bet are kept, so that the amount of bets and the
+// winners don't change, but the names and birthdate are replaced, and the
+// document is replaced by a pseudonym (see `pseudonym`).
+//
+// As the store is append only, it is rewritten with the same blocks,
+// which are chained again (and sealed with the keyring, if any), and
+// then replaced atomically. The storage must not be running meanwhile.
+// If there are no bets of the document, the store is not modified.
+func EraseDocument(path string, keyring *Keyring, document int) (erasure Erasure, err error) {
+	// a broken chain is not rewritten, as it would hide the break
+	chain, err := VerifyChainAt(path)
+	if err != nil {
+		return
+	}
+	erasure.OldHead = chain.Head
+	erasure.NewHead = chain.Head
+
+	erasure.Pseudonym, err = pseudonym(document)
+	if err != nil {
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := file.Close()
+		err = errors.Join(err, closeErr)
+	}()
+
+	var buf bytes.Buffer
+	head := GENESIS_HASH
+	err = readBlocks(file, keyring, func(bets []Bet) error {
+		for i := range bets {
+			if bets[i].Document == document {
+				bets[i].FirstName = ERASED_NAME
+				bets[i].LastName = ERASED_NAME
+				bets[i].Birthdate = ERASED_BIRTHDATE
+				bets[i].Document = erasure.Pseudonym
+				erasure.Bets++
+			}
+		}
+
+		var err error
+		head, err = appendBlock(&buf, head, bets, keyring)
+		return err
+	})
+	if err != nil || erasure.Bets == 0 {
+		return
+	}
+
+	err = replaceFile(path, buf.Bytes())
+	if err != nil {
+		return
+	}
+	erasure.NewHead = head
+
+	return
+}
+
+// Derives a negative pseudonym from the document, so that it can't
+// collide with real documents. It is salted with a random value, so that
+// it can't be reversed by hashing every possible document.
+func pseudonym(document int) (int, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return 0, err
+	}
+
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write([]byte(strconv.Itoa(document)))
+	sum := hash.Sum(nil)
+
+	return -int(binary.BigEndian.Uint64(sum[:8])>>2) - 1, nil
+}
+
+// Calls `fn` with the bets of each block of the store, opening the sealed
+// ones with the keyring
+func readBlocks(r io.Reader, keyring *Keyring, fn func(bets []Bet) error) error {
+	reader := safeio.NewReader(r)
+	bets := make([]Bet, 0)
+
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch row[0] {
+		case BLOCK_TAG:
+			err := fn(bets)
+			if err != nil {
+				return err
+			}
+			bets = make([]Bet, 0)
+		case SEALED_TAG:
+			batch, err := loadSealed(row, keyring)
+			if err != nil {
+				return err
+			}
+			bets = append(bets, batch...)
+		default:
+			bet, err := protocol.Deserialize[Bet](row)
+			if err != nil {
+				return err
+			}
+			bets = append(bets, bet)
+		}
+	}
+}
+
+// Replaces the file with the data, so that it is either fully replaced or
+// not at all
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err = errors.Join(err, closeErr); err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// makes the rename durable
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	syncErr := dir.Sync()
+	closeErr = dir.Close()
+	return errors.Join(syncErr, closeErr)
+}
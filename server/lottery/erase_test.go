@@ -0,0 +1,93 @@
+package lottery_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+)
+
+func TestEraseDocument(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "bets.csv")
+		storage := lottery.NewStorage(path)
+		var keyring *lottery.Keyring
+		if encrypted {
+			keyring = parseKeyring(t, "a:"+KEY_A, "")
+			storage = lottery.NewEncryptedStorage(path, keyring)
+		}
+
+		// the document 40000001 bets on both agencies
+		storeChainIn(t, storage, makeBets(1, 3), makeBets(2, 3))
+		before, _ := storage.Load()
+
+		erased := 40000001
+		erasure, err := lottery.EraseDocument(path, keyring, erased)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if erasure.Bets != 2 || erasure.Pseudonym >= 0 || erasure.NewHead == erasure.OldHead {
+			t.Fatalf("unexpected erasure %+v", erasure)
+		}
+
+		after, err := storage.Load()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(after) != len(before) {
+			t.Fatalf("expected %v bets, but got %v", len(before), len(after))
+		}
+		for i := range after {
+			// agency and number are kept, for the winners
+			if after[i].Agency != before[i].Agency || after[i].Number != before[i].Number {
+				t.Fatalf("expected %v to keep its agency and number, but got %v", before[i], after[i])
+			}
+			if before[i].Document != erased {
+				if after[i] != before[i] {
+					t.Fatalf("expected %v to be kept, but got %v", before[i], after[i])
+				}
+				continue
+			}
+			if after[i].Document != erasure.Pseudonym || after[i].FirstName != lottery.ERASED_NAME || !after[i].Birthdate.Equal(lottery.ERASED_BIRTHDATE) {
+				t.Fatalf("expected %v to be anonymized, but got %v", before[i], after[i])
+			}
+		}
+
+		chain, err := storage.Verify()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if chain.Head != erasure.NewHead || chain.Blocks != 2 {
+			t.Fatalf("expected the chain to end in %v, but got %+v", erasure.NewHead, chain)
+		}
+
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), strconv.Itoa(erased)) {
+			t.Fatalf("the store still contains the erased document")
+		}
+
+		// erasing it again finds nothing, and leaves the store as is
+		again, err := lottery.EraseDocument(path, keyring, erased)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		unchanged, _ := os.ReadFile(path)
+		if again.Bets != 0 || string(unchanged) != string(data) {
+			t.Fatalf("expected the store to be unchanged, but got %+v", again)
+		}
+	}
+}
+
+func TestEraseDocumentBrokenChain(t *testing.T) {
+	path, lines := storeChain(t, makeBets(1, 3))
+	lines[0] = strings.Replace(lines[0], "laura", "maria", 1)
+	_ = os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o666)
+
+	_, err := lottery.EraseDocument(path, nil, 40000000)
+	if err == nil {
+		t.Fatalf("expected a broken chain to not be rewritten")
+	}
+}
@@ -0,0 +1,136 @@
+package lottery
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// What to do with a bet for the same document and number as a stored one
+type DuplicatePolicy string
+
+const (
+	// duplicates are stored, as any other bet
+	AllowDuplicates DuplicatePolicy = "allow"
+	// duplicates of a bet of the same agency are rejected
+	AgencyDuplicates DuplicatePolicy = "agency"
+	// duplicates of a bet of any agency are rejected
+	GlobalDuplicates DuplicatePolicy = "global"
+)
+
+var ErrDuplicate = errors.New("duplicate bet")
+
+// The bettor reached the maximum amount of bets per draw
+var ErrBetLimit = errors.New("too many bets for the document")
+
+// An empty policy allows duplicates
+func ParseDuplicatePolicy(policy string) (DuplicatePolicy, error) {
+	switch DuplicatePolicy(policy) {
+	case "", AllowDuplicates:
+		return AllowDuplicates, nil
+	case AgencyDuplicates, GlobalDuplicates:
+		return DuplicatePolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy %q", policy)
+}
+
+// Identifies duplicate bets. The agency is zero if duplicates are global.
+type betKey struct {
+	agency   int
+	document int
+	number   int
+}
+
+// Stored bets, to check new ones against them. It is only used by the
+// writer of the storage, and is rebuilt from the store when it starts,
+// so it persists across restarts as the store does.
+type index struct {
+	duplicates DuplicatePolicy
+	bets       map[betKey]bool
+	// zero means unlimited
+	maxPerDocument int
+	// bets of each document, across every agency
+	perDocument map[int]int
+}
+
+func newIndex(duplicates DuplicatePolicy) *index {
+	return &index{
+		duplicates:  duplicates,
+		bets:        make(map[betKey]bool),
+		perDocument: make(map[int]int),
+	}
+}
+
+// Returns false if the index is not needed by its policies
+func (i *index) enabled() bool {
+	return i.rejectsDuplicates() || i.maxPerDocument > 0
+}
+
+func (i *index) rejectsDuplicates() bool {
+	return i.duplicates == AgencyDuplicates || i.duplicates == GlobalDuplicates
+}
+
+func (i *index) key(bet Bet) betKey {
+	key := betKey{document: bet.Document, number: bet.Number}
+	if i.duplicates == AgencyDuplicates {
+		key.agency = bet.Agency
+	}
+	return key
+}
+
+// Returns why the bet can't be stored, if it can't
+func (i *index) check(bet Bet) error {
+	if i.rejectsDuplicates() && i.bets[i.key(bet)] {
+		return ErrDuplicate
+	}
+	if i.maxPerDocument > 0 && i.perDocument[bet.Document] >= i.maxPerDocument {
+		return ErrBetLimit
+	}
+	return nil
+}
+
+func (i *index) add(bet Bet) {
+	if i.rejectsDuplicates() {
+		i.bets[i.key(bet)] = true
+	}
+	if i.maxPerDocument > 0 {
+		i.perDocument[bet.Document]++
+	}
+}
+
+// Undoes `add`, for bets that failed to be stored. They must have passed
+// `check`, so they were not indexed as duplicates before.
+func (i *index) remove(bet Bet) {
+	delete(i.bets, i.key(bet))
+	if i.maxPerDocument > 0 {
+		i.perDocument[bet.Document]--
+	}
+}
+
+// Indexes every bet of the store at `path`, if there is one
+func (i *index) load(path string, keyring *Keyring) (err error) {
+	if !i.enabled() {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := file.Close()
+		err = errors.Join(err, closeErr)
+	}()
+
+	bets, err := LoadBetsWith(file, keyring)
+	if err != nil {
+		return err
+	}
+	for _, bet := range bets {
+		i.add(bet)
+	}
+	return nil
+}
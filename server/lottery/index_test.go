@@ -0,0 +1,266 @@
+package lottery_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+)
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	policies := map[string]lottery.DuplicatePolicy{
+		"":       lottery.AllowDuplicates,
+		"allow":  lottery.AllowDuplicates,
+		"agency": lottery.AgencyDuplicates,
+		"global": lottery.GlobalDuplicates,
+	}
+	for value, expected := range policies {
+		policy, err := lottery.ParseDuplicatePolicy(value)
+		if err != nil || policy != expected {
+			t.Fatalf("expected %q to be %v, but got %v (%v)", value, expected, policy, err)
+		}
+	}
+
+	_, err := lottery.ParseDuplicatePolicy("none")
+	if err == nil {
+		t.Fatalf("expected an unknown policy to be invalid")
+	}
+}
+
+// Returns the indexes of the rejected bets, failing if any was rejected
+// for another reason
+func rejectedIndexes(t *testing.T, rejected []lottery.Rejection, reason error) []int {
+	indexes := make([]int, 0)
+	for _, rejection := range rejected {
+		if !errors.Is(rejection.Err, reason) {
+			t.Fatalf("unexpected rejection %v", rejection)
+		}
+		indexes = append(indexes, rejection.Index)
+	}
+	return indexes
+}
+
+func TestDuplicates(t *testing.T) {
+	stored := makeBets(1, 3)
+	batch := []lottery.Bet{
+		// same agency
+		stored[0],
+		// another agency
+		stored[1],
+		// a new bet, twice in the same batch
+		makeBets(2, 4)[3],
+		makeBets(2, 4)[3],
+	}
+	batch[1].Agency = 2
+
+	expected := map[lottery.DuplicatePolicy][]int{
+		lottery.AllowDuplicates:  {},
+		lottery.AgencyDuplicates: {0, 3},
+		lottery.GlobalDuplicates: {0, 1, 3},
+	}
+	for policy, expectedRejected := range expected {
+		storage := lottery.NewStorage(filepath.Join(t.TempDir(), "bets.csv"))
+		storage.SetDuplicatePolicy(policy)
+		runStorage(t, storage)
+
+		rejected, err := storage.Store(stored)
+		if err != nil || len(rejected) > 0 {
+			t.Fatalf("%v: expected the first batch to be stored, but got %v (%v)", policy, rejected, err)
+		}
+		rejected, err = storage.Store(batch)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !reflect.DeepEqual(rejectedIndexes(t, rejected, lottery.ErrDuplicate), expectedRejected) {
+			t.Fatalf("%v: expected rejected %v, but got %v", policy, expectedRejected, rejected)
+		}
+
+		// only the accepted bets are stored
+		bets, err := storage.Load()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(bets) != len(stored)+len(batch)-len(expectedRejected) {
+			t.Fatalf("%v: expected %v bets, but got %v", policy, len(stored)+len(batch)-len(expectedRejected), len(bets))
+		}
+	}
+}
+
+func TestDuplicatesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	keyring := parseKeyring(t, "a:"+KEY_A, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	storage := lottery.NewEncryptedStorage(path, keyring)
+	storage.SetDuplicatePolicy(lottery.GlobalDuplicates)
+	done := make(chan error)
+	go func() {
+		done <- storage.Run(ctx)
+	}()
+	_, err := storage.Store(makeBets(1, 5))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cancel()
+	err = <-done
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// the index is rebuilt from the store
+	storage = lottery.NewEncryptedStorage(path, keyring)
+	storage.SetDuplicatePolicy(lottery.GlobalDuplicates)
+	runStorage(t, storage)
+
+	rejected, err := storage.Store(makeBets(2, 6))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(rejectedIndexes(t, rejected, lottery.ErrDuplicate), []int{0, 1, 2, 3, 4}) {
+		t.Fatalf("expected the stored bets to be rejected, but got %v", rejected)
+	}
+}
+
+func TestDuplicatesConcurrent(t *testing.T) {
+	storage := lottery.NewStorage(filepath.Join(t.TempDir(), "bets.csv"))
+	storage.SetDuplicatePolicy(lottery.GlobalDuplicates)
+	runStorage(t, storage)
+
+	// every agency sends the same bets at once, only one of each is stored
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	stored := 0
+	for agency := 1; agency <= 10; agency++ {
+		wg.Add(1)
+		go func(agency int) {
+			defer wg.Done()
+			bets := makeBets(agency, 10)
+			rejected, err := storage.Store(bets)
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+			lock.Lock()
+			stored += len(bets) - len(rejected)
+			lock.Unlock()
+		}(agency)
+	}
+	wg.Wait()
+
+	bets, err := storage.Load()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if stored != 10 || len(bets) != 10 {
+		t.Fatalf("expected 10 bets to be stored, but got %v (%v loaded)", stored, len(bets))
+	}
+}
+
+// Bets of the same document, with consecutive numbers
+func makeDocumentBets(agency int, document int, count int) []lottery.Bet {
+	bets := makeBets(agency, count)
+	for i := range bets {
+		bets[i].Document = document
+	}
+	return bets
+}
+
+func TestBetLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	storage := lottery.NewStorage(path)
+	storage.SetMaxBetsPerDocument(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- storage.Run(ctx)
+	}()
+
+	// a document over the limit, and another one under it
+	batch := append(makeDocumentBets(1, 30904465, 3), makeDocumentBets(1, 44160273, 1)...)
+	rejected, err := storage.Store(batch)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(rejectedIndexes(t, rejected, lottery.ErrBetLimit), []int{2}) {
+		t.Fatalf("expected the third bet to be rejected, but got %v", rejected)
+	}
+	cancel()
+	err = <-done
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// the limit is across agencies, and the counts are rebuilt from the store
+	storage = lottery.NewStorage(path)
+	storage.SetMaxBetsPerDocument(2)
+	runStorage(t, storage)
+
+	rejected, err = storage.Store(append(makeDocumentBets(2, 30904465, 1), makeDocumentBets(2, 44160273, 2)...))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(rejectedIndexes(t, rejected, lottery.ErrBetLimit), []int{0, 2}) {
+		t.Fatalf("expected the bets over the limit to be rejected, but got %v", rejected)
+	}
+
+	bets, err := storage.Load()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(bets) != 4 {
+		t.Fatalf("expected 4 bets, but got %v", len(bets))
+	}
+}
+
+func TestBetLimitDuplicates(t *testing.T) {
+	storage := lottery.NewStorage(filepath.Join(t.TempDir(), "bets.csv"))
+	storage.SetDuplicatePolicy(lottery.GlobalDuplicates)
+	storage.SetMaxBetsPerDocument(2)
+	runStorage(t, storage)
+
+	// a rejected duplicate does not count towards the limit
+	bets := makeDocumentBets(1, 30904465, 3)
+	rejected, err := storage.Store([]lottery.Bet{bets[0], bets[0], bets[1], bets[2]})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []lottery.Rejection{
+		{Index: 1, Err: lottery.ErrDuplicate},
+		{Index: 3, Err: lottery.ErrBetLimit},
+	}
+	if !reflect.DeepEqual(rejected, expected) {
+		t.Fatalf("expected %v, but got %v", expected, rejected)
+	}
+}
+
+func TestBetLimitConcurrent(t *testing.T) {
+	storage := lottery.NewStorage(filepath.Join(t.TempDir(), "bets.csv"))
+	storage.SetMaxBetsPerDocument(3)
+	runStorage(t, storage)
+
+	// every agency bets for the same document at once
+	var wg sync.WaitGroup
+	for agency := 1; agency <= 10; agency++ {
+		wg.Add(1)
+		go func(agency int) {
+			defer wg.Done()
+			_, err := storage.Store(makeDocumentBets(agency, 30904465, 2))
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		}(agency)
+	}
+	wg.Wait()
+
+	bets, err := storage.Load()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(bets) != 3 {
+		t.Fatalf("expected 3 bets to be stored, but got %v", len(bets))
+	}
+}
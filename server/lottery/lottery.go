@@ -1,13 +1,15 @@
 package lottery
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"os"
 	"time"
 
-	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
 )
 
 const STORAGE_FILEPATH = "./bets.csv"
@@ -22,26 +24,17 @@ type Bet struct {
 	Number    int
 }
 
-func (b Bet) HasWon() bool {
-	return b.Number == LOTTERY_WINNER_NUMBER
+// Hides the personal data of the bettor when logged
+func (b Bet) Redact() any {
+	return fmt.Sprintf("{%v %v %v %v %v %v}", b.Agency, common.MASK, common.MASK, common.HashSensitive(b.Document), common.MASK, b.Number)
 }
 
-// Persist the information of each bet in the STORAGE_FILEPATH file.
-// Not thread-safe/process-safe.
-func StoreBets(bets []Bet) (err error) {
-	file, err := os.OpenFile(STORAGE_FILEPATH, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		return
-	}
-	defer func() {
-		closeErr := file.Close()
-		err = errors.Join(err, closeErr)
-	}()
-
-	err = StoreBetsIn(file, bets)
-	return
+func (b Bet) HasWon() bool {
+	return b.Number == LOTTERY_WINNER_NUMBER
 }
 
+// Writes the bets as lines of the store, without chaining them in a
+// block. To store bets, use `Storage`.
 func StoreBetsIn(w io.Writer, bets []Bet) (err error) {
 	writer := safeio.NewWriter(w)
 
@@ -54,23 +47,13 @@ func StoreBetsIn(w io.Writer, bets []Bet) (err error) {
 	return
 }
 
-// Loads the information all the bets in the STORAGE_FILEPATH file.
-// Not thread-safe/process-safe.
-func LoadBets() (bets []Bet, err error) {
-	file, err := os.Open(STORAGE_FILEPATH)
-	if err != nil {
-		return
-	}
-	defer func() {
-		closeErr := file.Close()
-		err = errors.Join(err, closeErr)
-	}()
-
-	bets, err = LoadBetsFrom(file)
-	return
+// Loads the bets of a store, skipping its blocks (see `VerifyChain`)
+func LoadBetsFrom(r io.Reader) ([]Bet, error) {
+	return LoadBetsWith(r, nil)
 }
 
-func LoadBetsFrom(r io.Reader) ([]Bet, error) {
+// Like `LoadBetsFrom`, but opens sealed batches with the keyring
+func LoadBetsWith(r io.Reader, keyring *Keyring) ([]Bet, error) {
 	reader := safeio.NewReader(r)
 	bets := make([]Bet, 0)
 
@@ -83,6 +66,18 @@ func LoadBetsFrom(r io.Reader) ([]Bet, error) {
 		if err != nil {
 			return bets, err
 		}
+		// blocks are checked by `VerifyChain`
+		if row[0] == BLOCK_TAG {
+			continue
+		}
+		if row[0] == SEALED_TAG {
+			batch, err := loadSealed(row, keyring)
+			if err != nil {
+				return bets, err
+			}
+			bets = append(bets, batch...)
+			continue
+		}
 
 		bet, err := protocol.Deserialize[Bet](row)
 		if err != nil {
@@ -94,3 +89,15 @@ func LoadBetsFrom(r io.Reader) ([]Bet, error) {
 
 	return bets, nil
 }
+
+// Opens a sealed batch with the keyring, and loads its bets
+func loadSealed(record []string, keyring *Keyring) ([]Bet, error) {
+	if keyring == nil {
+		return nil, errors.New("found a sealed batch, but there are no storage keys")
+	}
+	plain, err := keyring.open(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed batch: %w", err)
+	}
+	return LoadBetsFrom(bytes.NewReader(plain))
+}
@@ -0,0 +1,280 @@
+package lottery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrStorageClosed = errors.New("storage is closed")
+
+// Persists bets with a single writer goroutine, so that handlers don't
+// have to synchronize with each other.
+//
+// Batches that are submitted while a write is in progress are coalesced
+// into the next one (group commit), so that concurrent agencies share a
+// single write and fsync, instead of serializing on them. Each batch is
+// still chained as its own block (see `VerifyChain`).
+type Storage struct {
+	path     string
+	requests chan storeRequest
+	done     chan struct{}
+	// hash of the last block, only used by the writer
+	head string
+	// seals the stored batches, nil if they are stored in plaintext
+	keyring *Keyring
+	// stored bets, only used by the writer
+	index *index
+	// called after each commit, nil if there is none
+	commitHook CommitHook
+}
+
+type storeRequest struct {
+	bets   []Bet
+	tag    any
+	result chan storeResult
+}
+
+// A batch of a commit, once it is durable
+type CommittedBatch struct {
+	// given to `StoreTagged`
+	Tag      any
+	Stored   []Bet
+	Rejected []Rejection
+}
+
+// Called by the writer once the batches of a commit are durable, before
+// answering them. It is never called concurrently, so that it can also
+// persist something once per commit instead of once per batch.
+type CommitHook func(batches []CommittedBatch)
+
+type storeResult struct {
+	rejected []Rejection
+	err      error
+}
+
+// A bet of a batch that was not stored, and why
+type Rejection struct {
+	// position of the bet in the batch
+	Index int
+	Err   error
+}
+
+func NewStorage(path string) *Storage {
+	return &Storage{
+		path:     path,
+		requests: make(chan storeRequest),
+		done:     make(chan struct{}),
+		index:    newIndex(AllowDuplicates),
+	}
+}
+
+// Like `NewStorage`, but seals each batch with the active key of the
+// keyring (see `Keyring`). Batches stored in plaintext, or sealed with
+// older keys of the keyring, can still be loaded.
+func NewEncryptedStorage(path string, keyring *Keyring) *Storage {
+	storage := NewStorage(path)
+	storage.keyring = keyring
+	return storage
+}
+
+// Changes what to do with duplicate bets, which are allowed by default.
+// Must be called before `Run`.
+func (s *Storage) SetDuplicatePolicy(policy DuplicatePolicy) {
+	s.index.duplicates = policy
+}
+
+// Sets the hook to call after each commit. Must be called before `Run`.
+func (s *Storage) SetCommitHook(hook CommitHook) {
+	s.commitHook = hook
+}
+
+// Limits the bets of each document, across every agency. Bets over the
+// limit are rejected, zero means unlimited. Must be called before `Run`.
+func (s *Storage) SetMaxBetsPerDocument(max int) {
+	s.index.maxPerDocument = max
+}
+
+// Runs the writer until the context is done.
+// Must be called exactly once.
+func (s *Storage) Run(ctx context.Context) (err error) {
+	defer close(s.done)
+
+	// a broken chain is not extended, as it could not be verified
+	chain, err := VerifyChainAt(s.path)
+	if err != nil {
+		return err
+	}
+	s.head = chain.Head
+
+	err = s.index.load(s.path, s.keyring)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := file.Close()
+		err = errors.Join(err, closeErr)
+	}()
+
+	for {
+		var pending []storeRequest
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case request := <-s.requests:
+			pending = append(pending, request)
+		}
+
+		// coalesce every request that is already waiting
+	coalesce:
+		for {
+			select {
+			case request := <-s.requests:
+				pending = append(pending, request)
+			default:
+				break coalesce
+			}
+		}
+
+		results, fatalErr := s.commit(file, pending)
+		for i, request := range pending {
+			request.result <- results[i]
+		}
+		// the store could not be rolled back, so it is not extended
+		if fatalErr != nil {
+			return fatalErr
+		}
+	}
+}
+
+// Writes all pending batches at once, and waits until they are durable.
+// Bets rejected by the index are left out of their batch.
+//
+// If the write fails, the file is truncated back to its previous size, so
+// that a partial write does not break the chain. If that fails too, the
+// error is returned, and the writer must stop.
+func (s *Storage) commit(file *os.File, pending []storeRequest) ([]storeResult, error) {
+	results := make([]storeResult, len(pending))
+	// bets indexed by this commit, to forget them if it fails
+	indexed := make([]Bet, 0)
+	fail := func(err error) ([]storeResult, error) {
+		for _, bet := range indexed {
+			s.index.remove(bet)
+		}
+		for i := range results {
+			results[i] = storeResult{err: err}
+		}
+		return results, nil
+	}
+
+	var buf bytes.Buffer
+	head := s.head
+	committed := make([]CommittedBatch, 0, len(pending))
+	for i, request := range pending {
+		accepted := make([]Bet, 0, len(request.bets))
+		for j, bet := range request.bets {
+			// also checked against the previous bets of the commit
+			err := s.index.check(bet)
+			if err != nil {
+				results[i].rejected = append(results[i].rejected, Rejection{Index: j, Err: err})
+				continue
+			}
+			s.index.add(bet)
+			indexed = append(indexed, bet)
+			accepted = append(accepted, bet)
+		}
+
+		var err error
+		head, err = appendBlock(&buf, head, accepted, s.keyring)
+		if err != nil {
+			return fail(err)
+		}
+		committed = append(committed, CommittedBatch{
+			Tag:      request.tag,
+			Stored:   accepted,
+			Rejected: results[i].rejected,
+		})
+	}
+
+	// the file is opened for appending, so the end is where it writes
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fail(err)
+	}
+
+	_, err = file.Write(buf.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		results, _ := fail(err)
+		rollbackErr := file.Truncate(offset)
+		if rollbackErr == nil {
+			rollbackErr = file.Sync()
+		}
+		if rollbackErr != nil {
+			return results, fmt.Errorf("failed to roll back a failed write: %w", errors.Join(err, rollbackErr))
+		}
+		return results, nil
+	}
+
+	s.head = head
+	if s.commitHook != nil {
+		s.commitHook(committed)
+	}
+	return results, nil
+}
+
+// Stores the bets, returning once they are durable. Bets that can't be
+// stored (see `SetDuplicatePolicy` and `SetMaxBetsPerDocument`) are
+// returned as rejected, and the rest of them are stored anyway.
+// Safe to call concurrently.
+func (s *Storage) Store(bets []Bet) ([]Rejection, error) {
+	return s.StoreTagged(bets, nil)
+}
+
+// Like `Store`, but the batch is given to the commit hook with the tag
+func (s *Storage) StoreTagged(bets []Bet, tag any) ([]Rejection, error) {
+	request := storeRequest{
+		bets:   bets,
+		tag:    tag,
+		result: make(chan storeResult, 1),
+	}
+
+	select {
+	case s.requests <- request:
+	case <-s.done:
+		return nil, ErrStorageClosed
+	}
+
+	result := <-request.result
+	return result.rejected, result.err
+}
+
+// Verifies the chain of the stored bets, returning its head
+func (s *Storage) Verify() (Chain, error) {
+	return VerifyChainAt(s.path)
+}
+
+// Loads all the bets stored so far
+func (s *Storage) Load() (bets []Bet, err error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := file.Close()
+		err = errors.Join(err, closeErr)
+	}()
+
+	return LoadBetsWith(file, s.keyring)
+}
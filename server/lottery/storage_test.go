@@ -0,0 +1,211 @@
+package lottery_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+)
+
+func makeBets(agency int, count int) []lottery.Bet {
+	bets := make([]lottery.Bet, 0, count)
+	for i := 0; i < count; i++ {
+		bets = append(bets, lottery.Bet{
+			Agency:    agency,
+			FirstName: "laura",
+			LastName:  "lopez",
+			Document:  40000000 + i,
+			Birthdate: time.Date(2001, time.May, 1, 0, 0, 0, 0, time.UTC),
+			Number:    i,
+		})
+	}
+	return bets
+}
+
+func runStorage(t testing.TB, storage *lottery.Storage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- storage.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		err := <-done
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+	})
+}
+
+func TestStorageConcurrent(t *testing.T) {
+	storage := lottery.NewStorage(filepath.Join(t.TempDir(), "bets.csv"))
+	runStorage(t, storage)
+
+	var wg sync.WaitGroup
+	for agency := 1; agency <= 5; agency++ {
+		wg.Add(1)
+		go func(agency int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				_, err := storage.Store(makeBets(agency, 10))
+				if err != nil {
+					t.Errorf("%v", err)
+				}
+			}
+		}(agency)
+	}
+	wg.Wait()
+
+	bets, err := storage.Load()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	stored := make(map[int][]lottery.Bet)
+	for _, bet := range bets {
+		stored[bet.Agency] = append(stored[bet.Agency], bet)
+	}
+	for agency := 1; agency <= 5; agency++ {
+		expected := make([]lottery.Bet, 0)
+		for i := 0; i < 10; i++ {
+			expected = append(expected, makeBets(agency, 10)...)
+		}
+		if !reflect.DeepEqual(stored[agency], expected) {
+			t.Fatalf("agency %v: expected %v bets, but got %v", agency, len(expected), len(stored[agency]))
+		}
+	}
+
+	// coalesced batches are still chained one by one
+	chain, err := storage.Verify()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if chain.Blocks != 50 || chain.Bets != 500 {
+		t.Fatalf("expected 50 blocks with 500 bets, but got %v", chain)
+	}
+}
+
+func TestStorageClosed(t *testing.T) {
+	storage := lottery.NewStorage(filepath.Join(t.TempDir(), "bets.csv"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = storage.Run(ctx)
+
+	_, err := storage.Store(makeBets(1, 1))
+	if err != lottery.ErrStorageClosed {
+		t.Fatalf("expected %v, but got %v", lottery.ErrStorageClosed, err)
+	}
+}
+
+// Compares the group commit storage against a global lock, where each
+// batch is written and synced on its own, with an increasing number of
+// concurrent agencies.
+func BenchmarkStorage(b *testing.B) {
+	batch := makeBets(1, 140)
+
+	for _, agencies := range []int{1, 5, 20} {
+		b.Run(fmt.Sprintf("lock/agencies=%v", agencies), func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "bets.csv")
+			var lock sync.Mutex
+
+			benchmarkAgencies(b, agencies, len(batch), func() error {
+				lock.Lock()
+				defer lock.Unlock()
+
+				file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+
+				err = lottery.StoreBetsIn(file, batch)
+				if err != nil {
+					return err
+				}
+				return file.Sync()
+			})
+		})
+
+		b.Run(fmt.Sprintf("group/agencies=%v", agencies), func(b *testing.B) {
+			storage := lottery.NewStorage(filepath.Join(b.TempDir(), "bets.csv"))
+			runStorage(b, storage)
+
+			benchmarkAgencies(b, agencies, len(batch), func() error {
+				_, err := storage.Store(batch)
+				return err
+			})
+		})
+	}
+}
+
+// Stores b.N batches, split among concurrent agencies
+func benchmarkAgencies(b *testing.B, agencies int, batchSize int, store func() error) {
+	var wg sync.WaitGroup
+	for agency := 0; agency < agencies; agency++ {
+		wg.Add(1)
+		go func(agency int) {
+			defer wg.Done()
+			for i := agency; i < b.N; i += agencies {
+				err := store()
+				if err != nil {
+					b.Errorf("%v", err)
+				}
+			}
+		}(agency)
+	}
+	wg.Wait()
+
+	b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "bets/s")
+}
+
+func TestCommitHook(t *testing.T) {
+	storage := lottery.NewStorage(filepath.Join(t.TempDir(), "bets.csv"))
+	storage.SetDuplicatePolicy(lottery.AgencyDuplicates)
+
+	// only called by the writer, so it does not need to synchronize
+	commits := 0
+	stored := make(map[any]int)
+	rejected := make(map[any]int)
+	storage.SetCommitHook(func(batches []lottery.CommittedBatch) {
+		commits++
+		for _, batch := range batches {
+			stored[batch.Tag] += len(batch.Stored)
+			rejected[batch.Tag] += len(batch.Rejected)
+		}
+	})
+	runStorage(t, storage)
+
+	var wg sync.WaitGroup
+	for agency := 1; agency <= 10; agency++ {
+		wg.Add(1)
+		go func(agency int) {
+			defer wg.Done()
+			// the last bet is a duplicate of the first one
+			bets := makeBets(agency, 10)
+			bets = append(bets, bets[0])
+			_, err := storage.StoreTagged(bets, agency)
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		}(agency)
+	}
+	wg.Wait()
+
+	// the hook ran before the batches were answered
+	if commits < 1 || commits > 10 {
+		t.Fatalf("expected between 1 and 10 commits, but got %v", commits)
+	}
+	for agency := 1; agency <= 10; agency++ {
+		if stored[agency] != 10 || rejected[agency] != 1 {
+			t.Fatalf("agency %v: expected 10 stored and 1 rejected, but got %v and %v", agency, stored[agency], rejected[agency])
+		}
+	}
+}
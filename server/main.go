@@ -2,12 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"net"
+	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/safeio"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
 	"github.com/op/go-logging"
 	"github.com/spf13/viper"
 )
@@ -18,8 +28,35 @@ type config struct {
 	Default struct {
 		Server_Port           int
 		Server_Ip             string
+		Server_Listen         string
 		Server_Listen_Backlog int
+		Server_Reuse_Address  bool
+		Server_Tcp_Keepalive  time.Duration
+		Handshake_Timeout     time.Duration
+		Idle_Timeout          time.Duration
+		Io_Timeout            time.Duration
+		Keepalive_Period      time.Duration
+		Max_Connections       int
+		Busy_Retry_After      time.Duration
+		Agency_Rate_Limit     float64
+		Agency_Rate_Burst     int
+		Batch_Max_Bytes       int
+		Hub_Agencies          string
+		Tls_Cert              string
+		Tls_Key               string
+		Tls_Client_Ca         string
+		Agency_Secrets        string
+		Auth_Failure_Rate     float64
+		Auth_Failure_Burst    int
+		Receipt_Key           string
+		Storage_Keys          string
+		Storage_Keys_File     string
+		Storage_Key_Id        string
+		Audit_Log             string
+		Duplicate_Policy      string
+		Max_Bets_Per_Document int
 		Logging_Level         string
+		Log_Reveal_Sensitive  bool
 	}
 }
 
@@ -28,8 +65,40 @@ func initConfig() (config, error) {
 
 	_ = v.BindEnv("default.server_port", "SERVER_PORT")
 	_ = v.BindEnv("default.server_ip", "SERVER_IP")
+	_ = v.BindEnv("default.server_listen", "SERVER_LISTEN")
 	_ = v.BindEnv("default.server_listen_backlog", "SERVER_LISTEN_BACKLOG")
+	_ = v.BindEnv("default.server_reuse_address", "SERVER_REUSE_ADDRESS")
+	_ = v.BindEnv("default.server_tcp_keepalive", "SERVER_TCP_KEEPALIVE")
+	_ = v.BindEnv("default.handshake_timeout", "HANDSHAKE_TIMEOUT")
+	_ = v.BindEnv("default.idle_timeout", "IDLE_TIMEOUT")
+	_ = v.BindEnv("default.io_timeout", "IO_TIMEOUT")
+	_ = v.BindEnv("default.keepalive_period", "KEEPALIVE_PERIOD")
+	_ = v.BindEnv("default.max_connections", "MAX_CONNECTIONS")
+	_ = v.BindEnv("default.busy_retry_after", "BUSY_RETRY_AFTER")
+	_ = v.BindEnv("default.agency_rate_limit", "AGENCY_RATE_LIMIT")
+	_ = v.BindEnv("default.agency_rate_burst", "AGENCY_RATE_BURST")
+	_ = v.BindEnv("default.batch_max_bytes", "BATCH_MAX_BYTES")
+	_ = v.BindEnv("default.hub_agencies", "HUB_AGENCIES")
+	_ = v.BindEnv("default.tls_cert", "TLS_CERT")
+	_ = v.BindEnv("default.tls_key", "TLS_KEY")
+	_ = v.BindEnv("default.tls_client_ca", "TLS_CLIENT_CA")
+	_ = v.BindEnv("default.agency_secrets", "AGENCY_SECRETS")
+	_ = v.BindEnv("default.auth_failure_rate", "AUTH_FAILURE_RATE")
+	_ = v.BindEnv("default.auth_failure_burst", "AUTH_FAILURE_BURST")
+	_ = v.BindEnv("default.receipt_key", "RECEIPT_KEY")
+	_ = v.BindEnv("default.storage_keys", "STORAGE_KEYS")
+	_ = v.BindEnv("default.storage_keys_file", "STORAGE_KEYS_FILE")
+	_ = v.BindEnv("default.storage_key_id", "STORAGE_KEY_ID")
+	_ = v.BindEnv("default.audit_log", "AUDIT_LOG")
+	_ = v.BindEnv("default.duplicate_policy", "DUPLICATE_POLICY")
+	_ = v.BindEnv("default.max_bets_per_document", "MAX_BETS_PER_DOCUMENT")
 	_ = v.BindEnv("default.logging_level", "LOGGING_LEVEL")
+	_ = v.BindEnv("default.log_reveal_sensitive", "LOG_REVEAL_SENSITIVE")
+
+	// keeps the behavior of the standard library when unset
+	v.SetDefault("default.server_reuse_address", true)
+	// a batch must fit in a single packet
+	v.SetDefault("default.batch_max_bytes", safeio.MAX_PACKET_SIZE)
 
 	v.SetConfigFile("./config.ini")
 	_ = v.ReadInConfig()
@@ -44,11 +113,148 @@ func logConfig(c config) {
 	log.Infof(common.FmtLog("config", nil,
 		"server.ip", c.Default.Server_Ip,
 		"server.port", c.Default.Server_Port,
+		"server.listen", c.Default.Server_Listen,
 		"server.listen_backlog", c.Default.Server_Listen_Backlog,
+		"server.reuse_address", c.Default.Server_Reuse_Address,
+		"server.tcp_keepalive", c.Default.Server_Tcp_Keepalive,
+		"handshake.timeout", c.Default.Handshake_Timeout,
+		"idle.timeout", c.Default.Idle_Timeout,
+		"io.timeout", c.Default.Io_Timeout,
+		"keepalive.period", c.Default.Keepalive_Period,
+		"max_connections", c.Default.Max_Connections,
+		"busy.retry_after", c.Default.Busy_Retry_After,
+		"agency.rate_limit", c.Default.Agency_Rate_Limit,
+		"agency.rate_burst", c.Default.Agency_Rate_Burst,
+		"batch.max_bytes", c.Default.Batch_Max_Bytes,
+		"hub.agencies", c.Default.Hub_Agencies,
+		"tls.cert", c.Default.Tls_Cert,
+		"tls.key", c.Default.Tls_Key,
+		"tls.client_ca", c.Default.Tls_Client_Ca,
+		// secrets are not logged
+		"agency.secrets", c.Default.Agency_Secrets != "",
+		"auth.failure_rate", c.Default.Auth_Failure_Rate,
+		"auth.failure_burst", c.Default.Auth_Failure_Burst,
+		"receipt.key", c.Default.Receipt_Key,
+		// keys are not logged
+		"storage.keys", c.Default.Storage_Keys != "",
+		"storage.keys_file", c.Default.Storage_Keys_File,
+		"storage.key_id", c.Default.Storage_Key_Id,
+		"audit.log", c.Default.Audit_Log,
+		"duplicate.policy", c.Default.Duplicate_Policy,
+		"max_bets_per_document", c.Default.Max_Bets_Per_Document,
 		"logging.level", c.Default.Logging_Level,
+		"log.reveal_sensitive", c.Default.Log_Reveal_Sensitive,
+	))
+}
+
+// Loads the keyring of the bet store, from the environment (or config)
+// and the key file, both with the format of `lottery.ParseKeyring`.
+// Returns nil if there are no keys, so bets are stored in plaintext.
+func loadStorageKeys(keys string, keysFile string, activeId string) (*lottery.Keyring, error) {
+	if keysFile != "" {
+		data, err := os.ReadFile(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = strings.Join([]string{keys, string(data)}, ",")
+	}
+
+	if strings.Trim(keys, ", \n") == "" {
+		return nil, nil
+	}
+	return lottery.ParseKeyring(keys, activeId)
+}
+
+// Anonymizes the bets of the document, and records it in the audit log
+func eraseDocument(path string, keyring *lottery.Keyring, audit *auditLog, document int) {
+	erasure, err := lottery.EraseDocument(path, keyring, document)
+	// the erased document is not logged nor recorded, only its pseudonym
+	log.Info(common.FmtLog("erase", err,
+		"pseudonym", erasure.Pseudonym,
+		"bets", erasure.Bets,
+		"old_head", erasure.OldHead,
+		"new_head", erasure.NewHead,
+	))
+
+	auditErr := audit.record("erase", 0, auditError(map[string]any{
+		"pseudonym": erasure.Pseudonym,
+		"bets":      erasure.Bets,
+		"old_head":  erasure.OldHead,
+		"new_head":  erasure.NewHead,
+	}, err))
+	if auditErr != nil {
+		log.Fatalf("failed to record erasure: %s", auditErr)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// Walks the chain of the bet store, reporting its head or the first
+// break. Exits with an error if it is broken.
+func verifyStore(path string, audit *auditLog) {
+	chain, err := lottery.VerifyChainAt(path)
+	auditErr := audit.record("verify", 0, auditError(map[string]any{
+		"path":   path,
+		"blocks": chain.Blocks,
+		"head":   chain.Head,
+	}, err))
+	if auditErr != nil {
+		log.Fatalf("failed to record verification: %s", auditErr)
+	}
+	if err != nil {
+		// the chain is valid up to the last block before the break
+		log.Error(common.FmtLog("verify_store", err,
+			"path", path,
+			"valid_blocks", chain.Blocks,
+			"valid_head", chain.Head,
+		))
+		os.Exit(1)
+	}
+
+	log.Info(common.FmtLog("verify_store", nil,
+		"path", path,
+		"blocks", chain.Blocks,
+		"bets", chain.Bets,
+		"head", chain.Head,
 	))
 }
 
+// Prints the entries of the audit log that match the flags. The path of
+// the log may be given after the flags.
+func queryAuditLog(path string, args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	agencyId := flags.Int("agency", 0, "only entries of the agency")
+	from := flags.String("from", "", "only entries since the time (RFC 3339 or date)")
+	to := flags.String("to", "", "only entries before the time (RFC 3339 or date)")
+	_ = flags.Parse(args)
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+
+	filter := auditFilter{agencyId: *agencyId}
+	var err error
+	filter.from, err = parseAuditTime(*from)
+	if err != nil {
+		log.Fatalf("invalid from: %s", err)
+	}
+	filter.to, err = parseAuditTime(*to)
+	if err != nil {
+		log.Fatalf("invalid to: %s", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("failed to open audit log: %s", err)
+	}
+	defer file.Close()
+
+	_, err = queryAudit(file, filter, os.Stdout)
+	if err != nil {
+		log.Fatalf("failed to query audit log: %s", err)
+	}
+}
+
 func main() {
 	c, err := initConfig()
 	if err != nil {
@@ -59,10 +265,111 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to init logger: %s", err)
 	}
+	common.SetRevealSensitive(c.Default.Log_Reveal_Sensitive)
+
+	// `server audit [flags] [path]` queries the audit log, instead of
+	// serving
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		queryAuditLog(c.Default.Audit_Log, os.Args[2:])
+		return
+	}
+
+	audit, err := openAuditLog(c.Default.Audit_Log)
+	if err != nil {
+		log.Fatalf("failed to open audit log: %s", err)
+	}
+	defer audit.Close()
+
+	// `server verify [path]` checks the bet store, instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		path := lottery.STORAGE_FILEPATH
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		verifyStore(path, audit)
+		return
+	}
 
 	logConfig(c)
 
-	s, err := newServer(c.Default.Server_Port, c.Default.Server_Listen_Backlog)
+	addresses, err := listenAddresses(c.Default.Server_Listen, c.Default.Server_Ip, c.Default.Server_Port)
+	if err != nil {
+		log.Fatalf("failed to parse listen addresses: %s", err)
+	}
+
+	hubs, err := parseHubs(c.Default.Hub_Agencies)
+	if err != nil {
+		log.Fatalf("failed to parse hubs: %s", err)
+	}
+
+	agencySecrets, err := parseSecrets(c.Default.Agency_Secrets)
+	if err != nil {
+		log.Fatalf("failed to parse agency secrets: %s", err)
+	}
+
+	var receiptKey ed25519.PrivateKey
+	if c.Default.Receipt_Key != "" {
+		receiptKey, err = loadReceiptKey(c.Default.Receipt_Key)
+		if err != nil {
+			log.Fatalf("failed to load receipt key: %s", err)
+		}
+	}
+
+	storageKeys, err := loadStorageKeys(c.Default.Storage_Keys, c.Default.Storage_Keys_File, c.Default.Storage_Key_Id)
+	if err != nil {
+		log.Fatalf("failed to load storage keys: %s", err)
+	}
+
+	// `server erase <document>` anonymizes the bets of the document,
+	// instead of serving. The server must be stopped meanwhile.
+	if len(os.Args) > 2 && os.Args[1] == "erase" {
+		document, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			log.Fatalf("invalid document: %s", err)
+		}
+		eraseDocument(lottery.STORAGE_FILEPATH, storageKeys, audit, document)
+		return
+	}
+
+	duplicatePolicy, err := lottery.ParseDuplicatePolicy(c.Default.Duplicate_Policy)
+	if err != nil {
+		log.Fatalf("failed to parse duplicate policy: %s", err)
+	}
+
+	var tlsConfig *tls.Config
+	if c.Default.Tls_Cert != "" {
+		tlsConfig, err = transport.ServerTLS(c.Default.Tls_Cert, c.Default.Tls_Key, c.Default.Tls_Client_Ca)
+		if err != nil {
+			log.Fatalf("failed to load tls config: %s", err)
+		}
+	}
+
+	serverConfig := serverConfig{
+		addresses:          addresses,
+		listenBacklog:      c.Default.Server_Listen_Backlog,
+		reuseAddress:       c.Default.Server_Reuse_Address,
+		tcpKeepalive:       c.Default.Server_Tcp_Keepalive,
+		handshakeTimeout:   c.Default.Handshake_Timeout,
+		idleTimeout:        c.Default.Idle_Timeout,
+		ioTimeout:          c.Default.Io_Timeout,
+		keepalivePeriod:    c.Default.Keepalive_Period,
+		maxConnections:     c.Default.Max_Connections,
+		busyRetryAfter:     c.Default.Busy_Retry_After,
+		agencyRateLimit:    c.Default.Agency_Rate_Limit,
+		agencyRateBurst:    c.Default.Agency_Rate_Burst,
+		batchMaxBytes:      c.Default.Batch_Max_Bytes,
+		hubs:               hubs,
+		tls:                tlsConfig,
+		agencySecrets:      agencySecrets,
+		authFailureRate:    c.Default.Auth_Failure_Rate,
+		authFailureBurst:   c.Default.Auth_Failure_Burst,
+		receiptKey:         receiptKey,
+		storageKeys:        storageKeys,
+		audit:              audit,
+		duplicatePolicy:    duplicatePolicy,
+		maxBetsPerDocument: c.Default.Max_Bets_Per_Document,
+	}
+	s, err := newServer(serverConfig)
 	if err != nil {
 		log.Fatalf("failed to create server: %s", err)
 	}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Token bucket rate limiter, with an independent bucket for each key.
+// Each bucket starts full, and refills at `rate` tokens per second up to
+// `burst` tokens. A full bucket is the same as a missing one, so idle
+// buckets are dropped, and keys chosen by clients can't grow it forever.
+type rateLimiter[K comparable] struct {
+	rate    float64
+	burst   float64
+	lock    sync.Mutex
+	buckets map[K]*tokenBucket
+	// last time the full buckets were dropped
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Creates a rate limiter. If `rate` is zero, the limiter allows everything.
+func newRateLimiter[K comparable](rate float64, burst int) *rateLimiter[K] {
+	return &rateLimiter[K]{
+		rate:    rate,
+		burst:   math.Max(float64(burst), 1),
+		buckets: make(map[K]*tokenBucket),
+	}
+}
+
+// Takes `n` tokens from the bucket of `key`. If there are not enough
+// tokens, nothing is taken, and it returns how long to wait before
+// trying again.
+//
+// Requests larger than the burst are allowed once the bucket is full,
+// leaving the bucket in debt, as they could never be allowed otherwise.
+func (l *rateLimiter[K]) take(key K, n int) (bool, time.Duration) {
+	if l.rate == 0 {
+		return true, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	bucket := l.refill(key)
+
+	required := math.Min(float64(n), l.burst)
+	if bucket.tokens < required {
+		missing := required - bucket.tokens
+		return false, time.Duration(missing / l.rate * float64(time.Second))
+	}
+
+	bucket.tokens -= float64(n)
+	return true, 0
+}
+
+// Like `take` with a single token, but without taking it
+func (l *rateLimiter[K]) peek(key K) (bool, time.Duration) {
+	if l.rate == 0 {
+		return true, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// peeking must not create buckets, as every client peeks
+	if _, ok := l.buckets[key]; !ok {
+		return true, 0
+	}
+
+	bucket := l.refill(key)
+	if bucket.tokens < 1 {
+		missing := 1 - bucket.tokens
+		return false, time.Duration(missing / l.rate * float64(time.Second))
+	}
+
+	return true, 0
+}
+
+// Returns the bucket of `key` with the tokens earned since it was last
+// used. Must be called with the lock held.
+func (l *rateLimiter[K]) refill(key K) *tokenBucket {
+	now := time.Now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.tokens = math.Min(bucket.tokens+elapsed*l.rate, l.burst)
+	bucket.last = now
+
+	return bucket
+}
+
+// Drops the buckets that refilled completely, at most once per the time
+// it takes to refill an empty bucket. Thus, only the buckets used within
+// the last two of those periods are kept. Must be called with the lock
+// held.
+func (l *rateLimiter[K]) sweep(now time.Time) {
+	refillTime := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < refillTime {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		elapsed := now.Sub(bucket.last).Seconds()
+		if bucket.tokens+elapsed*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter[int](100, 10)
+
+	ok, _ := limiter.take(1, 10)
+	if !ok {
+		t.Fatalf("expected a full bucket to allow a burst")
+	}
+
+	ok, retryAfter := limiter.take(1, 5)
+	if ok {
+		t.Fatalf("expected an empty bucket to reject")
+	}
+	if retryAfter <= 0 || retryAfter > 50*time.Millisecond {
+		t.Fatalf("expected to retry after ~50ms, but got %v", retryAfter)
+	}
+
+	ok, _ = limiter.take(2, 10)
+	if !ok {
+		t.Fatalf("expected buckets to be independent")
+	}
+
+	time.Sleep(retryAfter + time.Millisecond)
+	ok, _ = limiter.take(1, 5)
+	if !ok {
+		t.Fatalf("expected the bucket to refill after %v", retryAfter)
+	}
+
+	unlimited := newRateLimiter[int](0, 0)
+	ok, _ = unlimited.take(1, 1000)
+	if !ok {
+		t.Fatalf("expected a zero rate to disable the limiter")
+	}
+}
+
+func TestRateLimiterPeek(t *testing.T) {
+	limiter := newRateLimiter[string](1, 2)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.peek("10.0.0.1")
+		if !ok {
+			t.Fatalf("expected peek to not take tokens")
+		}
+	}
+
+	limiter.take("10.0.0.1", 2)
+	ok, retryAfter := limiter.peek("10.0.0.1")
+	if ok {
+		t.Fatalf("expected an empty bucket to reject")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Fatalf("expected to retry after ~1s, but got %v", retryAfter)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	// each bucket refills in 10ms
+	limiter := newRateLimiter[int](100, 1)
+
+	for key := 1; key <= 100; key++ {
+		limiter.take(key, 1)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// the idle buckets are full, so they are dropped
+	limiter.take(0, 1)
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("expected a single bucket, but got %v", len(limiter.buckets))
+	}
+
+	// peeking a missing bucket does not create it
+	ok, _ := limiter.peek(1)
+	if !ok || len(limiter.buckets) != 1 {
+		t.Fatalf("expected peek to allow without creating a bucket, but got %v buckets", len(limiter.buckets))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+)
+
+// Loads the key that signs the receipts, from a PKCS #8 PEM file. If the
+// file does not exist, a new key is generated and saved, along with its
+// public key (see `publicKeyPath`), which agencies use to verify them.
+func loadReceiptKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return generateReceiptKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%v is not a PEM file", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ed25519Key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%v is not an Ed25519 key", path)
+	}
+
+	return ed25519Key, nil
+}
+
+func generateReceiptKey(path string) (ed25519.PrivateKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	privateDer, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDer, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer}), 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(publicKeyPath(path), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}), 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info(common.FmtLog("generate_receipt_key", nil,
+		"path", path,
+		"public_key", publicKeyPath(path),
+	))
+	return private, nil
+}
+
+// The public key is saved next to the private key, with `.pub` extension
+func publicKeyPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".pub"
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadReceiptKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipt.key")
+
+	generated, err := loadReceiptKey(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), "receipt.pub")); err != nil {
+		t.Fatalf("expected the public key to be saved: %v", err)
+	}
+
+	loaded, err := loadReceiptKey(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !loaded.Equal(generated) {
+		t.Fatalf("expected the saved key to be loaded")
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.key")
+	_ = os.WriteFile(invalid, []byte("not a key"), 0o600)
+	_, err = loadReceiptKey(invalid)
+	if err == nil {
+		t.Fatalf("expected an invalid key to fail")
+	}
+}
@@ -2,28 +2,97 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
 	"github.com/juliangcalderon-fiuba/distribuidos-tp0/server/lottery"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
 )
 
 const MAX_AGENCIES = 5
 
+type serverConfig struct {
+	addresses        []transport.Address
+	listenBacklog    int
+	reuseAddress     bool
+	tcpKeepalive     time.Duration
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+	ioTimeout        time.Duration
+	keepalivePeriod  time.Duration
+	// zero means unlimited. Must be at least MAX_AGENCIES, as each
+	// agency holds its connection until the draw
+	maxConnections  int
+	busyRetryAfter  time.Duration
+	agencyRateLimit float64
+	agencyRateBurst int
+	// maximum encoded size of a batch, counting its header. Zero means
+	// unlimited
+	batchMaxBytes int
+	// agencies that each hub may multiplex over its connection, by hub id
+	hubs map[int][]int
+	// nil if TLS is disabled. If it requires client certificates, the
+	// agency id is taken from them
+	tls *tls.Config
+	// secret of each agency, by id. If empty, agencies don't authenticate
+	agencySecrets map[int][]byte
+	// failed authentications per second allowed from each source
+	authFailureRate  float64
+	authFailureBurst int
+	// signs the receipt of each stored batch. If nil, they are not signed
+	receiptKey ed25519.PrivateKey
+	// seals the stored bets. If nil, they are stored in plaintext
+	storageKeys *lottery.Keyring
+	// records the protocol and admin events. If nil, they are not recorded
+	audit *auditLog
+	// what to do with bets that were already stored
+	duplicatePolicy lottery.DuplicatePolicy
+	// bets of each document per draw, across agencies. Zero means unlimited
+	maxBetsPerDocument int
+}
+
 type server struct {
-	listener       net.Listener
-	storageLock    *sync.RWMutex
-	lotteryFinish  *sync.WaitGroup
+	config serverConfig
+	// identifies this run of the server in receipts, as the sequence
+	// numbers of the batches restart on every run
+	runId         string
+	listeners     []net.Listener
+	storage       *lottery.Storage
+	lotteryFinish *sync.WaitGroup
+	// agencies that already finished, each one counts once towards the draw
+	finished     map[int]bool
+	finishedLock *sync.Mutex
+	// closed once the draw is done, the winners are set by then
+	drawDone       chan struct{}
+	winners        map[int][]int
+	chainHead      string
+	drawErr        error
+	events         *events
 	activeHandlers *sync.WaitGroup
+	stats          *stats
+	// holds a token for each handled connection, nil if unlimited
+	connections chan struct{}
+	// limits the bets per second of each agency
+	agencyLimiter *rateLimiter[int]
+	// limits the failed authentications of each source address
+	authLimiter *rateLimiter[string]
 }
 
-func newServer(port int, listenBacklog int) (*server, error) {
-	_ = listenBacklog
-	address := fmt.Sprintf("0.0.0.0:%v", port)
-	listener, err := net.Listen("tcp", address)
+func newServer(config serverConfig) (*server, error) {
+	err := validateConnections(config.maxConnections, config.busyRetryAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners, err := listen(config)
 	if err != nil {
 		return nil, err
 	}
@@ -31,68 +100,260 @@ func newServer(port int, listenBacklog int) (*server, error) {
 	lotteryFinish := &sync.WaitGroup{}
 	lotteryFinish.Add(MAX_AGENCIES)
 
-	return &server{
-		listener:       listener,
+	storage := lottery.NewStorage(lottery.STORAGE_FILEPATH)
+	if config.storageKeys != nil {
+		storage = lottery.NewEncryptedStorage(lottery.STORAGE_FILEPATH, config.storageKeys)
+	}
+	storage.SetDuplicatePolicy(config.duplicatePolicy)
+	storage.SetMaxBetsPerDocument(config.maxBetsPerDocument)
+
+	runId, err := protocol.NewNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	var connections chan struct{}
+	if config.maxConnections > 0 {
+		connections = make(chan struct{}, config.maxConnections)
+	}
+
+	s := &server{
+		config:         config,
+		runId:          runId,
+		listeners:      listeners,
 		lotteryFinish:  lotteryFinish,
-		storageLock:    &sync.RWMutex{},
+		finished:       make(map[int]bool),
+		finishedLock:   &sync.Mutex{},
+		drawDone:       make(chan struct{}),
+		events:         newEvents(),
+		storage:        storage,
 		activeHandlers: &sync.WaitGroup{},
-	}, nil
+		stats:          &stats{},
+		connections:    connections,
+		agencyLimiter:  newRateLimiter[int](config.agencyRateLimit, config.agencyRateBurst),
+		authLimiter:    newRateLimiter[string](config.authFailureRate, config.authFailureBurst),
+	}
+	storage.SetCommitHook(s.auditCommit)
+
+	return s, nil
+}
+
+// Checks the connection limit, if any. Every agency must be admitted at
+// once, as the draw waits for all of them, and refused clients must be
+// told when to retry.
+func validateConnections(maxConnections int, busyRetryAfter time.Duration) error {
+	if maxConnections == 0 {
+		return nil
+	}
+	if maxConnections < MAX_AGENCIES {
+		return fmt.Errorf("max connections must be 0 or at least %v, got %v", MAX_AGENCIES, maxConnections)
+	}
+	if busyRetryAfter <= 0 {
+		return fmt.Errorf("busy retry after must be positive, got %v", busyRetryAfter)
+	}
+	return nil
 }
 
 func (s *server) run(ctx context.Context) (err error) {
-	listenerCloser := common.SpawnCloser(ctx, s.listener, closeListener)
-	defer func() {
-		closeErr := listenerCloser.Close()
-		err = errors.Join(err, closeErr)
+	log.Info(common.FmtLog("start", nil,
+		"run_id", s.runId,
+	))
+	s.recordAudit("start", 0, map[string]any{
+		"run_id": s.runId,
+	})
+
+	// the storage outlives the handlers, so that in-flight batches are
+	// committed before exiting
+	storageCtx, stopStorage := context.WithCancel(context.Background())
+	storageErr := make(chan error, 1)
+	go func() {
+		err := s.storage.Run(storageCtx)
+		if err != nil {
+			log.Error(common.FmtLog("storage", err))
+		}
+		storageErr <- err
 	}()
 
+	go s.draw()
+
 	handlerCtx, cancelHandlerCtx := context.WithCancel(ctx)
 	defer func() {
 		cancelHandlerCtx()
 		s.activeHandlers.Wait()
+		stopStorage()
+		err = errors.Join(err, <-storageErr)
+		s.stats.log()
 	}()
 
+	closers := make([]common.Closer, 0, len(s.listeners))
+	acceptErrs := make(chan error, len(s.listeners))
+	for _, listener := range s.listeners {
+		closers = append(closers, common.SpawnCloser(ctx, listener, closeListener))
+		go func(listener net.Listener) {
+			acceptErrs <- s.acceptClients(handlerCtx, listener)
+		}(listener)
+	}
+
+	// the first listener to fail stops the rest of them
+	err = <-acceptErrs
+	for _, closer := range closers {
+		closeErr := closer.Close()
+		err = errors.Join(err, closeErr)
+	}
+	for i := 1; i < len(s.listeners); i++ {
+		<-acceptErrs
+	}
+
+	return err
+}
+
+// Accepts clients from the listener until it fails
+func (s *server) acceptClients(ctx context.Context, listener net.Listener) error {
+	log.Info(common.FmtLog("listen", nil,
+		"address", listener.Addr(),
+	))
+
 	for {
-		h, err := s.acceptClient()
+		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
-		if h != nil {
-			s.activeHandlers.Add(1)
-			go func(h *handler) {
-				err := h.run(handlerCtx)
-				if err != nil {
-					if !errors.Is(err, net.ErrClosed) {
-						log.Error(common.FmtLog("handle_client", err))
-					}
-				}
+
+		// the handshake is done in the connection goroutine, so that
+		// a slow client can't stall the admission of other clients
+		s.activeHandlers.Add(1)
+		if !s.admit() {
+			go func(conn net.Conn) {
+				s.refuseClient(ctx, conn)
 				s.activeHandlers.Done()
-			}(h)
+			}(conn)
+			continue
 		}
+		go func(conn net.Conn) {
+			s.handleClient(ctx, conn)
+			s.release()
+			s.activeHandlers.Done()
+		}(conn)
 	}
 }
 
-func (s *server) acceptClient() (*handler, error) {
-	for {
-		conn, err := s.listener.Accept()
-		if err != nil {
-			return nil, err
-		}
+// Takes a connection slot, returns false if there are none left
+func (s *server) admit() bool {
+	if s.connections == nil {
+		return true
+	}
 
-		h, err := createHandler(s, conn)
-		if err != nil {
-			log.Error(common.FmtLog("handshake", err))
-			continue
+	select {
+	case s.connections <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns a connection slot taken with `admit`
+func (s *server) release() {
+	if s.connections != nil {
+		<-s.connections
+	}
+}
+
+// Answers the client handshake with a busy error, so that it retries later
+func (s *server) refuseClient(ctx context.Context, conn net.Conn) {
+	closer := common.SpawnCloser(ctx, conn, closeConnection)
+	defer func() {
+		// errors are already logged by `closeConnection`
+		_ = closer.Close()
+	}()
+
+	refused := s.stats.connectionsRefused.Add(1)
+	s.recordRejection(conn, 0, "busy", nil)
+
+	err := common.SetDeadline(conn.SetDeadline, s.config.handshakeTimeout)
+	if err == nil {
+		_, err = protocol.Receive[protocol.HelloMessage](protocol.NewReader(conn))
+	}
+	if err == nil {
+		err = protocol.SendFlush(protocol.ErrMessage{
+			Reason:     protocol.BusyReason,
+			RetryAfter: int(s.config.busyRetryAfter.Milliseconds()),
+		}, protocol.NewWriter(conn))
+	}
+
+	log.Warning(common.FmtLog("refuse_connection", err,
+		"remote_address", conn.RemoteAddr(),
+		"connections_refused", refused,
+	))
+}
+
+// Handles a client connection from the handshake until it is closed
+func (s *server) handleClient(ctx context.Context, conn net.Conn) {
+	closer := common.SpawnCloser(ctx, conn, closeConnection)
+	defer func() {
+		// errors are already logged by `closeConnection`
+		_ = closer.Close()
+	}()
+
+	h, err := s.handshake(conn)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			timeouts := s.stats.handshakeTimeouts.Add(1)
+			log.Warning(common.FmtLog("handshake", err,
+				"remote_address", conn.RemoteAddr(),
+				"handshake_timeouts", timeouts,
+			))
+		} else if errors.Is(err, errUnauthenticated) {
+			failures := s.stats.authFailures.Add(1)
+			log.Warning(common.FmtLog("authenticate", err,
+				"remote_address", conn.RemoteAddr(),
+				"auth_failures", failures,
+			))
+		} else if !errors.Is(err, net.ErrClosed) {
+			log.Error(common.FmtLog("handshake", err,
+				"remote_address", conn.RemoteAddr(),
+			))
 		}
+		return
+	}
 
-		log.Info(common.FmtLog("handshake", nil,
-			"agency_id", h.agencyId,
-		))
+	log.Info(common.FmtLog("handshake", nil,
+		"agency_id", h.agencyId,
+		"codec", h.codec.Code(),
+		"compression", h.compression.Code(),
+	))
+	// the identity was verified against the certificate, if any
+	_, certificate := transport.PeerName(conn)
+	s.recordAudit("handshake", h.agencyId, map[string]any{
+		"remote_address": conn.RemoteAddr().String(),
+		"hub":            h.hub,
+		"authenticated":  len(s.config.agencySecrets) > 0,
+		"certificate":    certificate,
+	})
 
-		return h, nil
+	err = h.run(ctx)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		s.stats.sessionTimeouts.Add(1)
+	}
+	if err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			log.Error(common.FmtLog("handle_client", err,
+				"agency_id", h.agencyId,
+			))
+		}
 	}
 }
 
+// Creates a handler for the connection, failing if the client does not
+// complete the handshake within the configured timeout (if any)
+func (s *server) handshake(conn net.Conn) (*handler, error) {
+	err := common.SetDeadline(conn.SetDeadline, s.config.handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return createHandler(s, conn)
+}
+
 func closeListener(listener net.Listener) error {
 	err := listener.Close()
 	if err != nil {
@@ -102,13 +363,67 @@ func closeListener(listener net.Listener) error {
 	return nil
 }
 
-func (s *server) getWinners() (map[int][]int, error) {
-	s.storageLock.RLock()
-	allBets, err := lottery.LoadBets()
-	s.storageLock.RUnlock()
+// Marks the agency as finished. Returns false if it had already finished,
+// as it may happen if an agency reconnects.
+func (s *server) finishAgency(agencyId int) bool {
+	s.finishedLock.Lock()
+	defer s.finishedLock.Unlock()
+
+	if s.finished[agencyId] {
+		return false
+	}
+	s.finished[agencyId] = true
+	s.lotteryFinish.Done()
+
+	if len(s.finished) == MAX_AGENCIES-1 {
+		s.events.publish(protocol.ClosingSoonEvent)
+	}
+
+	return true
+}
+
+// Waits for every agency to finish, and computes the winners once for
+// all the handlers
+func (s *server) draw() {
+	s.lotteryFinish.Wait()
+	s.events.publish(protocol.DrawStartedEvent)
+
+	s.winners, s.chainHead, s.drawErr = s.getWinners()
+	log.Info(common.FmtLog("sorteo", s.drawErr,
+		"chain_head", s.chainHead,
+	))
+
+	winners := 0
+	for _, agencyWinners := range s.winners {
+		winners += len(agencyWinners)
+	}
+	// the draw is deterministic, the chain head identifies its bets
+	s.recordAudit("draw", 0, auditError(map[string]any{
+		"run_id":     s.runId,
+		"number":     lottery.LOTTERY_WINNER_NUMBER,
+		"winners":    winners,
+		"chain_head": s.chainHead,
+	}, s.drawErr))
 
+	// published before the winners are sent, so that subscribers receive
+	// it first
+	if s.drawErr == nil {
+		s.events.publish(protocol.DrawCompletedEvent)
+	}
+	close(s.drawDone)
+}
+
+// Computes the winners, once the bet store is verified. Returns them with
+// the head of its chain.
+func (s *server) getWinners() (map[int][]int, string, error) {
+	chain, err := s.storage.Verify()
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	allBets, err := s.storage.Load()
+	if err != nil {
+		return nil, "", err
 	}
 
 	winners := make(map[int][]int)
@@ -119,5 +434,5 @@ func (s *server) getWinners() (map[int][]int, error) {
 		}
 	}
 
-	return winners, nil
+	return winners, chain.Head, nil
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	s := newTestServer(t, serverConfig{
+		handshakeTimeout: 100 * time.Millisecond,
+	})
+
+	conn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	done := make(chan struct{})
+	go func() {
+		s.handleClient(context.Background(), serverConn)
+		close(done)
+	}()
+
+	// the client never sends its HELLO
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the handshake to time out")
+	}
+
+	_, err := protocol.ReceiveAny(protocol.NewReader(conn))
+	if err == nil {
+		t.Fatalf("expected the connection to be closed")
+	}
+	if timeouts := s.stats.handshakeTimeouts.Load(); timeouts != 1 {
+		t.Fatalf("expected 1 handshake timeout, but got %v", timeouts)
+	}
+}
+
+func TestValidateConnections(t *testing.T) {
+	valid := []struct {
+		maxConnections int
+		busyRetryAfter time.Duration
+	}{
+		{0, 0},
+		{MAX_AGENCIES, time.Second},
+	}
+	for _, c := range valid {
+		err := validateConnections(c.maxConnections, c.busyRetryAfter)
+		if err != nil {
+			t.Fatalf("expected %v connections retried after %v to be valid, but got %v", c.maxConnections, c.busyRetryAfter, err)
+		}
+	}
+
+	// the draw would wait for agencies that can't be admitted, and
+	// refused clients would give up
+	invalid := []struct {
+		maxConnections int
+		busyRetryAfter time.Duration
+	}{
+		{-1, time.Second},
+		{MAX_AGENCIES - 1, time.Second},
+		{MAX_AGENCIES, 0},
+	}
+	for _, c := range invalid {
+		err := validateConnections(c.maxConnections, c.busyRetryAfter)
+		if err == nil {
+			t.Fatalf("expected %v connections retried after %v to be invalid", c.maxConnections, c.busyRetryAfter)
+		}
+	}
+}
+
+func TestRefuseBusy(t *testing.T) {
+	s := newTestServer(t, serverConfig{
+		maxConnections: MAX_AGENCIES,
+		busyRetryAfter: 500 * time.Millisecond,
+	})
+
+	address, _ := transport.ParseAddress("pipe://busy")
+	listener, err := transport.Listen(context.Background(), net.ListenConfig{}, address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		_ = s.acceptClients(context.Background(), listener)
+	}()
+
+	// answers the handshake of a new connection
+	hello := func(agencyId int) (net.Conn, protocol.Message) {
+		conn, err := transport.Dial(context.Background(), address)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		_ = protocol.SendFlush(protocol.HelloMessage{
+			AgencyId:    agencyId,
+			Codec:       protocol.CsvCode,
+			Compression: protocol.NoCompression,
+		}, protocol.NewWriter(conn))
+		answer, err := protocol.ReceiveAny(protocol.NewReader(conn))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return conn, answer
+	}
+
+	conns := make([]net.Conn, 0, MAX_AGENCIES)
+	for agencyId := 1; agencyId <= MAX_AGENCIES; agencyId++ {
+		conn, answer := hello(agencyId)
+		if answer != (protocol.OkMessage{}) {
+			t.Fatalf("expected agency %v to be admitted, but got %v", agencyId, answer)
+		}
+		conns = append(conns, conn)
+	}
+
+	_, answer := hello(1)
+	if answer != (protocol.ErrMessage{Reason: protocol.BusyReason, RetryAfter: 500}) {
+		t.Fatalf("expected the server to be busy, but got %v", answer)
+	}
+	if refused := s.stats.connectionsRefused.Load(); refused != 1 {
+		t.Fatalf("expected 1 connection refused, but got %v", refused)
+	}
+
+	// once a connection closes, its slot is taken by the next one
+	_ = conns[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, answer = hello(1)
+		if answer == (protocol.OkMessage{}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the connection slot to be released, but got %v", answer)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
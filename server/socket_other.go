@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"syscall"
+)
+
+// Socket options are only supported on unix systems, elsewhere the
+// system defaults are kept.
+func setSocketOptions(_ syscall.RawConn, _ serverConfig) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+)
+
+// Sets the configured options on a listening socket, before it is bound.
+// Called from the `net.ListenConfig` control hook.
+func setSocketOptions(conn syscall.RawConn, config serverConfig) error {
+	reuseAddress := 0
+	if config.reuseAddress {
+		reuseAddress = 1
+	}
+
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, reuseAddress)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
+)
+
+func TestReuseAddress(t *testing.T) {
+	for _, reuseAddress := range []bool{true, false} {
+		listeners, err := listen(serverConfig{
+			addresses:    []transport.Address{{Network: transport.TCP, Address: "127.0.0.1:0"}},
+			reuseAddress: reuseAddress,
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer listeners[0].Close()
+
+		conn, err := listeners[0].(syscall.Conn).SyscallConn()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		var value int
+		var sockErr error
+		err = conn.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR)
+		})
+		if err != nil || sockErr != nil {
+			t.Fatalf("%v, %v", err, sockErr)
+		}
+		if (value != 0) != reuseAddress {
+			t.Fatalf("expected SO_REUSEADDR to be %v, but got %v", reuseAddress, value)
+		}
+	}
+}
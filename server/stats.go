@@ -0,0 +1,30 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/common"
+)
+
+// Counters of noteworthy events, shared by all handlers
+type stats struct {
+	handshakeTimeouts  atomic.Int64
+	sessionTimeouts    atomic.Int64
+	connectionsRefused atomic.Int64
+	batchesLimited     atomic.Int64
+	authFailures       atomic.Int64
+	duplicateBets      atomic.Int64
+	betsOverLimit      atomic.Int64
+}
+
+func (s *stats) log() {
+	log.Info(common.FmtLog("stats", nil,
+		"handshake_timeouts", s.handshakeTimeouts.Load(),
+		"session_timeouts", s.sessionTimeouts.Load(),
+		"connections_refused", s.connectionsRefused.Load(),
+		"batches_limited", s.batchesLimited.Load(),
+		"auth_failures", s.authFailures.Load(),
+		"duplicate_bets", s.duplicateBets.Load(),
+		"bets_over_limit", s.betsOverLimit.Load(),
+	))
+}
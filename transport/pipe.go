@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Pipe listeners live in a process wide registry, by name. Dialing a
+// pipe creates a `net.Pipe`, and hands one of its ends to the listener.
+
+var errConnectionRefused = errors.New("connection refused")
+
+var pipes = make(map[string]*pipeListener)
+var pipesLock sync.Mutex
+
+type pipeListener struct {
+	name      string
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return Pipe
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+func listenPipe(name string) (net.Listener, error) {
+	pipesLock.Lock()
+	defer pipesLock.Unlock()
+
+	if _, ok := pipes[name]; ok {
+		return nil, fmt.Errorf("pipe %q is already in use", name)
+	}
+
+	listener := &pipeListener{
+		name:  name,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	pipes[name] = listener
+
+	return listener, nil
+}
+
+func dialPipe(ctx context.Context, name string) (net.Conn, error) {
+	pipesLock.Lock()
+	listener, ok := pipes[name]
+	pipesLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("pipe %q: %w", name, errConnectionRefused)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case listener.conns <- server:
+		return client, nil
+	case <-listener.done:
+		return nil, fmt.Errorf("pipe %q: %w", name, errConnectionRefused)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Stops accepting connections, and frees the name of the pipe
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		pipesLock.Lock()
+		delete(pipes, l.name)
+		pipesLock.Unlock()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// TLS is optional, and is layered on top of any transport. With mutual
+// TLS, both peers present a certificate signed by a trusted CA, so the
+// server can take the identity of the client from it.
+
+// Creates the TLS config of a server. If `clientCaFile` is given, clients
+// must present a certificate signed by it (mutual TLS).
+func ServerTLS(certFile string, keyFile string, clientCaFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCaFile != "" {
+		config.ClientCAs, err = loadCertPool(clientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// Creates the TLS config of a client, which verifies that the server
+// certificate is signed by `caFile` and valid for `serverName`. If
+// `certFile` is given, it is presented to the server.
+func ClientTLS(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	rootCAs, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		RootCAs:    rootCAs,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Returns the common name of the verified certificate of the peer. Fails
+// if the connection is not TLS, or the peer did not present a certificate.
+// Must be called after the TLS handshake.
+func PeerName(conn net.Conn) (string, bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", caFile)
+	}
+
+	return pool, nil
+}
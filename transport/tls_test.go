@@ -0,0 +1,134 @@
+package transport_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
+)
+
+// Writes a certificate and its key to `dir`, signed by `parent` (or self
+// signed, if nil). Returns the paths of the certificate and the key.
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	_ = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certPath, keyPath, cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	caPath, _, ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	serverCert, serverKey, _, _ := writeCert(t, dir, "server", ca, caKey)
+	agencyCert, agencyKey, _, _ := writeCert(t, dir, "agency-1", ca, caKey)
+
+	serverConfig, err := transport.ServerTLS(serverCert, serverKey, caPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// pipes are not buffered, so the TLS handshake could deadlock on them
+	listener, err := transport.Listen(context.Background(), net.ListenConfig{}, transport.Address{
+		Network: transport.TCP,
+		Address: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer listener.Close()
+	address := transport.Address{Network: transport.TCP, Address: listener.Addr().String()}
+	listener = tls.NewListener(listener, serverConfig)
+
+	names := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// completes the handshake
+			_, _ = conn.Read(make([]byte, 1))
+			name, _ := transport.PeerName(conn)
+			names <- name
+			_ = conn.Close()
+		}
+	}()
+
+	dial := func(certFile string, keyFile string) error {
+		clientConfig, err := transport.ClientTLS(caPath, certFile, keyFile, "server")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		conn, err := transport.Dial(context.Background(), address)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer conn.Close()
+
+		tlsConn := tls.Client(conn, clientConfig)
+		err = tlsConn.Handshake()
+		if err == nil {
+			_, err = tlsConn.Write([]byte{0})
+		}
+		if err == nil {
+			// the server only rejects a missing certificate after the
+			// handshake, when it reads
+			_, err = tlsConn.Read(make([]byte, 1))
+		}
+		return err
+	}
+
+	_ = dial(agencyCert, agencyKey)
+	if name := <-names; name != "agency-1" {
+		t.Fatalf("expected peer agency-1, but got %q", name)
+	}
+
+	err = dial("", "")
+	if err == nil {
+		t.Fatalf("expected a client without certificate to be rejected")
+	}
+	if name := <-names; name != "" {
+		t.Fatalf("expected no peer, but got %q", name)
+	}
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// A transport carries the byte stream of a connection. The rest of the
+// stack only depends on `net.Conn`, so any of them can be used:
+// - `tcp://host:port`: A TCP connection.
+// - `unix:///path/to/socket`: A unix domain socket, for co-located
+//   deployments.
+// - `pipe://name`: An in-memory connection, for tests within a single
+//   process.
+
+const (
+	TCP  = "tcp"
+	Unix = "unix"
+	Pipe = "pipe"
+)
+
+type Address struct {
+	// One of `TCP`, `Unix` or `Pipe`
+	Network string
+	// The host and port, the socket path, or the pipe name
+	Address string
+}
+
+// Parses an address with the format `scheme://address`. Addresses without
+// a scheme are assumed to be TCP.
+func ParseAddress(address string) (Address, error) {
+	scheme, rest, ok := strings.Cut(address, "://")
+	if !ok {
+		return Address{TCP, address}, nil
+	}
+
+	switch scheme {
+	case TCP, Unix, Pipe:
+	default:
+		return Address{}, fmt.Errorf("unknown transport %q in address %q", scheme, address)
+	}
+	if rest == "" {
+		return Address{}, fmt.Errorf("missing address in %q", address)
+	}
+
+	return Address{scheme, rest}, nil
+}
+
+func (a Address) String() string {
+	return a.Network + "://" + a.Address
+}
+
+// Listens on the address. TCP and unix listeners are created with the
+// given config, which is ignored for pipes.
+func Listen(ctx context.Context, config net.ListenConfig, address Address) (net.Listener, error) {
+	switch address.Network {
+	case TCP, Unix:
+		return config.Listen(ctx, address.Network, address.Address)
+	case Pipe:
+		return listenPipe(address.Address)
+	default:
+		return nil, fmt.Errorf("unknown transport %q", address.Network)
+	}
+}
+
+// Connects to the address
+func Dial(ctx context.Context, address Address) (net.Conn, error) {
+	switch address.Network {
+	case TCP, Unix:
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, address.Network, address.Address)
+	case Pipe:
+		return dialPipe(ctx, address.Address)
+	default:
+		return nil, fmt.Errorf("unknown transport %q", address.Network)
+	}
+}
@@ -0,0 +1,102 @@
+package transport_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/protocol"
+	"github.com/juliangcalderon-fiuba/distribuidos-tp0/transport"
+)
+
+func TestParseAddress(t *testing.T) {
+	cases := map[string]transport.Address{
+		"server:12345":          {transport.TCP, "server:12345"},
+		"tcp://[::1]:12345":     {transport.TCP, "[::1]:12345"},
+		"unix:///tmp/lottery":   {transport.Unix, "/tmp/lottery"},
+		"pipe://lottery-server": {transport.Pipe, "lottery-server"},
+	}
+	for raw, expected := range cases {
+		address, err := transport.ParseAddress(raw)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if address != expected {
+			t.Fatalf("expected %v, but got %v", expected, address)
+		}
+	}
+
+	for _, invalid := range []string{"udp://server:12345", "unix://"} {
+		_, err := transport.ParseAddress(invalid)
+		if err == nil {
+			t.Fatalf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestTransports(t *testing.T) {
+	addresses := []transport.Address{
+		{transport.TCP, "127.0.0.1:0"},
+		{transport.Unix, filepath.Join(t.TempDir(), "lottery.sock")},
+		{transport.Pipe, "lottery-test"},
+	}
+
+	for _, address := range addresses {
+		listener, err := transport.Listen(context.Background(), net.ListenConfig{}, address)
+		if err != nil {
+			t.Fatalf("%v: %v", address, err)
+		}
+		defer listener.Close()
+
+		// dial the bound address, as the TCP port is chosen by the system
+		dialAddress := transport.Address{address.Network, listener.Addr().String()}
+
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, err = protocol.Receive[protocol.PingMessage](protocol.NewReader(conn))
+			if err == nil {
+				_ = protocol.SendFlush(protocol.PongMessage{}, protocol.NewWriter(conn))
+			}
+		}()
+
+		conn, err := transport.Dial(context.Background(), dialAddress)
+		if err != nil {
+			t.Fatalf("%v: %v", address, err)
+		}
+
+		err = protocol.SendFlush(protocol.PingMessage{}, protocol.NewWriter(conn))
+		if err == nil {
+			_, err = protocol.Receive[protocol.PongMessage](protocol.NewReader(conn))
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", address, err)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestPipeClosed(t *testing.T) {
+	address := transport.Address{transport.Pipe, "lottery-closed"}
+
+	listener, err := transport.Listen(context.Background(), net.ListenConfig{}, address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, err = transport.Listen(context.Background(), net.ListenConfig{}, address)
+	if err == nil {
+		t.Fatalf("expected the pipe to be in use")
+	}
+
+	_ = listener.Close()
+	_, err = transport.Dial(context.Background(), address)
+	if err == nil {
+		t.Fatalf("expected dialing a closed pipe to fail")
+	}
+}